@@ -1,6 +1,7 @@
 package api
 
 import (
+    "context"
     "encoding/json"
     "log"
     "net/http"
@@ -26,6 +27,8 @@ type ApiConfig struct {
     Blocks                 int64    `json:"blocks"`
     PurgeOnly              bool     `json:"purgeOnly"`
     PurgeInterval          string   `json:"purgeInterval"`
+    // Admin endpoints are enabled only if token is set
+    AdminToken             string   `json:"adminToken"`
 }
 
 type ApiServer struct {
@@ -37,6 +40,7 @@ type ApiServer struct {
     miners                 map[string]*Entry
     minersMu               sync.RWMutex
     statsIntv              time.Duration
+    httpServer             *http.Server
 }
 
 type Entry struct {
@@ -53,6 +57,7 @@ func NewApiServer(cfg *ApiConfig, backend *storage.RedisClient) *ApiServer {
         hashrateWindow:      hashrateWindow,
         hashrateLargeWindow: hashrateLargeWindow,
         miners:              make(map[string]*Entry),
+        httpServer:          &http.Server{Addr: cfg.Listen},
     }
 }
 
@@ -107,13 +112,26 @@ func (s *ApiServer) listen() {
     r.HandleFunc("/api/blocks", s.BlocksIndex)
     r.HandleFunc("/api/payments", s.PaymentsIndex)
     r.HandleFunc("/api/accounts/{login:M[A-Z0-9]{1}[0-9a-zA-Z]{32}$}", s.AccountIndex)
+    if len(s.config.AdminToken) > 0 {
+        r.HandleFunc("/api/admin/resume/{module:[a-z]+}", util.BearerAuth(s.config.AdminToken, s.ResumeModule)).Methods("POST")
+    }
     r.NotFoundHandler = http.HandlerFunc(notFound)
-    err := http.ListenAndServe(s.config.Listen, r)
-    if err != nil {
+    s.httpServer.Handler = r
+    err := s.httpServer.ListenAndServe()
+    if err != nil && err != http.ErrServerClosed {
         log.Fatalf("Failed to start API: %v", err)
     }
 }
 
+func (s *ApiServer) Stop(ctx context.Context) {
+    err := s.httpServer.Shutdown(ctx)
+    if err != nil {
+        log.Printf("Failed to stop API: %v", err)
+        return
+    }
+    log.Println("API stopped")
+}
+
 func notFound(w http.ResponseWriter, r *http.Request) {
     w.Header().Set("Content-Type", "application/json; charset=UTF-8")
     w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -145,6 +163,11 @@ func (s *ApiServer) collectStats() {
             return
         }
     }
+    stats["halts"], err = s.backend.GetHalts()
+    if err != nil {
+        log.Printf("Failed to fetch halts from backend: %v", err)
+        return
+    }
     s.stats.Store(stats)
     log.Printf("Stats collection finished %s", time.Since(start))
 }
@@ -165,22 +188,15 @@ func (s *ApiServer) StatsIndex(w http.ResponseWriter, r *http.Request) {
     
     nodes := make([]map[string]interface{}, len(nodeStats))
     for id, node := range nodeStats {
-        nodeName := node["name"].(string)
+        nodeName, _ := node["name"].(string)
         stratum, err := s.backend.GetStratumStates(nodeName)
         if err != nil {
             log.Printf("Failed to get stratum stats from backend: %v", err)
         }
         if stratum != nil {
-            nodes[id] = map[string]interface{}{
-                "name": nodeName,
-                "height": node["height"],
-                "difficulty": node["difficulty"],
-                "lastBeat": node["lastBeat"],
-                "stratums": stratum,
-            }
-        } else {
-            nodes[id] = node
+            node["stratums"] = stratum
         }
+        nodes[id] = node
     }
     reply["nodes"] = nodes
 
@@ -190,9 +206,13 @@ func (s *ApiServer) StatsIndex(w http.ResponseWriter, r *http.Request) {
         reply["stats"] = stats["stats"]
         reply["hashrate"] = stats["hashrate"]
         reply["minersTotal"] = stats["minersTotal"]
+        reply["soloHashrate"] = stats["soloHashrate"]
+        reply["soloMinersTotal"] = stats["soloMinersTotal"]
+        reply["pps"] = stats["pps"]
         reply["maturedTotal"] = stats["maturedTotal"]
         reply["immatureTotal"] = stats["immatureTotal"]
         reply["candidatesTotal"] = stats["candidatesTotal"]
+        reply["halts"] = stats["halts"]
     }
 
     err = json.NewEncoder(w).Encode(reply)
@@ -214,6 +234,9 @@ func (s *ApiServer) MinersIndex(w http.ResponseWriter, r *http.Request) {
         reply["miners"] = stats["miners"]
         reply["hashrate"] = stats["hashrate"]
         reply["minersTotal"] = stats["minersTotal"]
+        reply["soloMiners"] = stats["soloMiners"]
+        reply["soloHashrate"] = stats["soloHashrate"]
+        reply["soloMinersTotal"] = stats["soloMinersTotal"]
     }
 
     err := json.NewEncoder(w).Encode(reply)
@@ -317,6 +340,32 @@ func (s *ApiServer) AccountIndex(w http.ResponseWriter, r *http.Request) {
     }
 }
 
+// Clears halt of unlocker or payouts module, it resumes on next run
+func (s *ApiServer) ResumeModule(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+    w.Header().Set("Cache-Control", "no-cache")
+
+    module := mux.Vars(r)["module"]
+    ok, err := s.backend.ResumeHalt(module)
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        log.Printf("Failed to resume %s: %v", module, err)
+        return
+    }
+    if !ok {
+        w.WriteHeader(http.StatusNotFound)
+        return
+    }
+    log.Printf("Resumed %s by admin request from %s", module, r.RemoteAddr)
+
+    w.WriteHeader(http.StatusOK)
+    reply := map[string]interface{}{"resumed": module}
+    err = json.NewEncoder(w).Encode(reply)
+    if err != nil {
+        log.Println("Error serializing admin API response: ", err)
+    }
+}
+
 func (s *ApiServer) getStats() map[string]interface{} {
     stats := s.stats.Load()
     if stats != nil {
@@ -1,12 +1,15 @@
 package main
 
 import (
+    "context"
     "encoding/json"
     "log"
     "math/rand"
     "os"
+    "os/signal"
     "path/filepath"
     "runtime"
+    "syscall"
     "time"
 
     "github.com/yvasiyarov/gorelic"
@@ -15,29 +18,80 @@ import (
     "github.com/NotoriousPyro/open-metaverse-pool/payouts"
     "github.com/NotoriousPyro/open-metaverse-pool/proxy"
     "github.com/NotoriousPyro/open-metaverse-pool/storage"
+    "github.com/NotoriousPyro/open-metaverse-pool/util"
 )
 
+const defaultShutdownTimeout = 30 * time.Second
+
 var cfg proxy.Config
 var backend *storage.RedisClient
 
+var proxyServer *proxy.ProxyServer
+var apiServer *api.ApiServer
+var blockUnlocker *payouts.BlockUnlocker
+var payoutsProcessor *payouts.PayoutsProcessor
+var reorgWatcher *payouts.ReorgWatcher
+
 func startProxy() {
-    s := proxy.NewProxy(&cfg, backend)
-    s.Start()
+    proxyServer = proxy.NewProxy(&cfg, backend)
+    go proxyServer.Start()
 }
 
 func startApi() {
-    s := api.NewApiServer(&cfg.Api, backend)
-    s.Start()
+    apiServer = api.NewApiServer(&cfg.Api, backend)
+    go apiServer.Start()
 }
 
 func startBlockUnlocker() {
-    u := payouts.NewBlockUnlocker(&cfg.BlockUnlocker, backend)
-    u.Start()
+    blockUnlocker = payouts.NewBlockUnlocker(&cfg.BlockUnlocker, backend)
+    go blockUnlocker.Start()
 }
 
 func startPayoutsProcessor() {
-    u := payouts.NewPayoutsProcessor(&cfg.Payouts, backend)
-    u.Start()
+    payoutsProcessor = payouts.NewPayoutsProcessor(&cfg.Payouts, backend)
+    go payoutsProcessor.Start()
+}
+
+func startReorgWatcher() {
+    reorgWatcher = payouts.NewReorgWatcher(&cfg.ReorgWatcher, backend)
+    go reorgWatcher.Start()
+}
+
+// Stops modules in order: listeners and stratum sessions first, then unlocker and payouts
+func shutdown() {
+    timeout := defaultShutdownTimeout
+    if len(cfg.ShutdownTimeout) > 0 {
+        timeout = util.MustParseDuration(cfg.ShutdownTimeout)
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+
+    done := make(chan struct{})
+    go func() {
+        if apiServer != nil {
+            apiServer.Stop(ctx)
+        }
+        if proxyServer != nil {
+            proxyServer.Stop(ctx)
+        }
+        if blockUnlocker != nil {
+            blockUnlocker.Stop()
+        }
+        if payoutsProcessor != nil {
+            payoutsProcessor.Stop()
+        }
+        if reorgWatcher != nil {
+            reorgWatcher.Stop()
+        }
+        close(done)
+    }()
+
+    select {
+    case <-done:
+        log.Println("Shutdown complete")
+    case <-ctx.Done():
+        log.Fatalf("Shutdown timed out after %v", timeout)
+    }
 }
 
 func startNewrelic() {
@@ -71,6 +125,9 @@ func readConfig(cfg *proxy.Config) {
     cfg.Payouts.Password = cfg.Password
     cfg.BlockUnlocker.Account = cfg.Account
     cfg.BlockUnlocker.Password = cfg.Password
+    cfg.BlockUnlocker.RewardSchedule = cfg.RewardSchedule
+    cfg.ReorgWatcher.Account = cfg.Account
+    cfg.ReorgWatcher.Password = cfg.Password
 }
 
 func main() {
@@ -93,17 +150,24 @@ func main() {
     }
 
     if cfg.Proxy.Enabled {
-        go startProxy()
+        startProxy()
     }
     if cfg.Api.Enabled {
-        go startApi()
+        startApi()
     }
     if cfg.BlockUnlocker.Enabled {
-        go startBlockUnlocker()
+        startBlockUnlocker()
     }
     if cfg.Payouts.Enabled {
-        go startPayoutsProcessor()
+        startPayoutsProcessor()
     }
-    quit := make(chan bool)
-    <-quit
+    if cfg.ReorgWatcher.Enabled {
+        startReorgWatcher()
+    }
+
+    quit := make(chan os.Signal, 1)
+    signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+    sig := <-quit
+    log.Printf("Received %v, shutting down", sig)
+    shutdown()
 }
@@ -0,0 +1,77 @@
+package payouts
+
+import (
+    "log"
+    "time"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/storage"
+)
+
+const (
+    UnlockerModule = "unlocker"
+    PayoutsModule = "payouts"
+)
+
+const (
+    // Node calls are retried this many times with doubling delay before the run is skipped
+    rpcRetries = 3
+    rpcRetryDelay = 2 * time.Second
+)
+
+// Halt after accounting error is kept in backend, so it survives restarts until resumed through API.
+// It's kept in memory until backend can be written, so it can be resumed the same way.
+type haltState struct {
+    module        string
+    backend       *storage.RedisClient
+    halt          bool
+    lastFail      error
+}
+
+func (h *haltState) halted() bool {
+    if h.halt {
+        err := h.backend.WriteHalt(h.module, h.lastFail.Error())
+        if err != nil {
+            log.Printf("Module %s suspended due to last critical error: %v, failed to write halt state to backend: %v", h.module, h.lastFail, err)
+            return true
+        }
+        h.halt = false
+        h.lastFail = nil
+    }
+    reason, err := h.backend.GetHalt(h.module)
+    if err != nil {
+        log.Printf("Unable to check %s halt state: %v", h.module, err)
+        return true
+    }
+    if len(reason) > 0 {
+        log.Printf("Module %s suspended due to last critical error: %s", h.module, reason)
+        return true
+    }
+    return false
+}
+
+func (h *haltState) haltOn(err error) {
+    werr := h.backend.WriteHalt(h.module, err.Error())
+    if werr != nil {
+        log.Printf("Failed to write %s halt state to backend, retrying on next run: %v", h.module, werr)
+        h.halt = true
+        h.lastFail = err
+    }
+}
+
+// Retries transient node errors, gives up at once on shutdown
+func retry(quit chan struct{}, name string, fn func() error) error {
+    delay := rpcRetryDelay
+    for i := 0; ; i++ {
+        err := fn()
+        if err == nil || i == rpcRetries {
+            return err
+        }
+        log.Printf("%s failed, retrying in %v: %v", name, delay, err)
+        select {
+        case <-time.After(delay):
+        case <-quit:
+            return err
+        }
+        delay *= 2
+    }
+}
@@ -6,6 +6,7 @@ import (
     "math/big"
     "os"
     "strconv"
+    "sync"
     "time"
 
     "github.com/NotoriousPyro/open-metaverse-pool/rpc"
@@ -15,7 +16,8 @@ import (
 
 const (
     txCheckInterval = 5 * time.Second
-    failedTxReceiptRestartDelay = 10 * time.Minute
+    maxTxChecks = 59
+    defaultBatchSize = 20
 )
 
 type PayoutsConfig struct {
@@ -30,18 +32,28 @@ type PayoutsConfig struct {
     Account         string
     Password        string
     Address         string   `json:"address"`
+    // Payees paid in one transaction
+    BatchSize       int      `json:"batchSize"`
 }
 
 type PayoutsProcessor struct {
     config      *PayoutsConfig
     backend     *storage.RedisClient
     rpc         *rpc.RPCClient
-    halt        bool
-    lastFail    error
+    haltState
+    batchSize   int
+    quit        chan struct{}
+    // Held during payout session, so Stop can wait for it
+    runMu       sync.Mutex
 }
 
 func NewPayoutsProcessor(cfg *PayoutsConfig, backend *storage.RedisClient) *PayoutsProcessor {
-    u := &PayoutsProcessor{config: cfg, backend: backend}
+    u := &PayoutsProcessor{config: cfg, backend: backend, quit: make(chan struct{})}
+    u.haltState = haltState{module: PayoutsModule, backend: backend}
+    u.batchSize = defaultBatchSize
+    if cfg.BatchSize > 0 {
+        u.batchSize = cfg.BatchSize
+    }
     if len(cfg.Address) != 0 && !util.IsValidHexAddress(cfg.Address) {
         log.Fatalln("Invalid Payouts Address", cfg.Address)
     }
@@ -64,7 +76,7 @@ func (u *PayoutsProcessor) Start() {
 
     intv := util.MustParseDuration(u.config.Interval)
     timer := time.NewTimer(intv)
-    log.Printf("Set payouts interval to %v", intv)
+    log.Printf("Set payouts interval to %v, paying up to %v payees per transaction", intv, u.batchSize)
 
     payments := u.backend.GetPendingPayments()
     if len(payments) > 0 {
@@ -84,23 +96,52 @@ func (u *PayoutsProcessor) Start() {
     }
 
     // Immediately process payouts after start
-    u.process()
+    u.run()
     timer.Reset(intv)
 
     go func() {
         for {
             select {
             case <-timer.C:
-                u.process()
+                u.run()
                 timer.Reset(intv)
+            case <-u.quit:
+                timer.Stop()
+                return
             }
         }
     }()
 }
 
+// Waits for current payment to be logged and prevents further payouts,
+// confirmation of logged payment isn't waited for
+func (u *PayoutsProcessor) Stop() {
+    close(u.quit)
+    u.runMu.Lock()
+    u.runMu.Unlock()
+    log.Println("Payouts stopped")
+}
+
+func (u *PayoutsProcessor) stopped() bool {
+    select {
+    case <-u.quit:
+        return true
+    default:
+        return false
+    }
+}
+
+func (u *PayoutsProcessor) run() {
+    u.runMu.Lock()
+    defer u.runMu.Unlock()
+    if u.stopped() {
+        return
+    }
+    u.process()
+}
+
 func (u *PayoutsProcessor) process() {
-    if u.halt {
-        log.Println("Payments suspended due to last critical error:", u.lastFail)
+    if u.halted() {
         return
     }
     err := u.backend.UnlockPayouts()
@@ -108,9 +149,6 @@ func (u *PayoutsProcessor) process() {
         log.Println("Failed to unlock payouts:", err)
         return
     }
-    mustPay := 0
-    minersPaid := 0
-    totalAmount := big.NewInt(0)
     payees, err := u.backend.GetPayees()
     if err != nil {
         log.Println("Error while retrieving payees from backend:", err)
@@ -118,104 +156,13 @@ func (u *PayoutsProcessor) process() {
     }
     
     u.rpc.SetAddress(u.config.Address)
-    
-    Payments:
-        for _, login := range payees {
-            amount, _ := u.backend.GetBalance(login)
-            amountInShannon := big.NewInt(amount)
-            if !u.reachedThreshold(amountInShannon) {
-                continue
-            }
-            mustPay++
-
-            // Require active peers before processing
-            if !u.checkPeers() {
-                log.Println("Insufficient peers for payment... Will delay until next run.")
-                break
-            }
 
-            // Check if we have enough funds
-            getBalance, err := u.rpc.GetBalance(u.config.Address)
-            if err != nil {
-                u.halt = true
-                u.lastFail = err
-                break
-            }
-            poolBalance := big.NewInt(getBalance.Unspent)
-
-            if poolBalance.Cmp(amountInShannon) < 0 {
-                err := fmt.Errorf("Not enough balance for payment, need %s Satoshi, pool has %s Satoshi",
-                    amountInShannon.String(), poolBalance.String())
-                u.halt = true
-                u.lastFail = err
-                break
-            }
-            
-            // Lock payments for current payout
-            err = u.backend.LockPayouts(login, amount)
-            if err != nil {
-                log.Printf("Failed to lock payment for %s: %v", login, err)
-                u.halt = true
-                u.lastFail = err
-                break
-            }
-            log.Printf("Locked payment for %s, %v Satoshi", login, amount)
-
-            txHash, err := u.rpc.SendTransaction(u.config.Address, login, strconv.FormatInt(amount, 10))
-            if err != nil || txHash == "" {
-                log.Printf("Failed to send payment to %s, %v Satoshi: %v. Check outgoing tx for %s in block explorer and docs/PAYOUTS.md",
-                    login, amount, err, login)
-                u.halt = true
-                u.lastFail = err
-                break
-            }
-            
-            maxTxChecks := 59
-            txChecks := 0
-            // Wait for TX confirmation before further payouts
-            Transaction:
-                for {
-                    log.Printf("Waiting for TxReceipt: %v", txHash)
-                    time.Sleep(txCheckInterval)
-                    receipt, err := u.rpc.GetTransaction(txHash)
-                    
-                    if receipt != nil && receipt.Confirmed() && txHash == receipt.Hash {
-                        log.Printf("TxReceipt confirmed for Miner %s: Satoshi: %v, Tx: %s", login, amount, txHash)
-                        
-                        // Debit miner's balance and update stats
-                        err = u.backend.UpdateBalance(login, amount)
-                        if err != nil {
-                            log.Printf("Failed to update balance for Miner: %s, Satoshi: %v [%v]", login, amount, err)
-                            u.halt = true
-                            u.lastFail = err
-                            break Payments
-                        }
-                        log.Printf("Balance updated for Miner: %s, Satoshi: %v", login, amount)
-                        
-                        // Log transaction hash
-                        err = u.backend.WritePayment(login, txHash, amount)
-                        if err != nil {
-                            log.Printf("Failed to log TxReceipt for Miner: %s, Satoshi: %v, Tx: %s [%v]", login, amount, txHash, err)
-                            u.halt = true
-                            u.lastFail = err
-                            break Payments
-                        }
-                        log.Printf("TxReceipt logged for Miner: %s, Satoshi: %v, Tx: %s", login, amount, txHash)
-                        break Transaction
-                    }
-                    
-                    if err != nil && txChecks > maxTxChecks {
-                        log.Printf("Restarting payouts in 10 minutes to reattempt payment. Failed to get TxReceipt %s: %s", login, txHash)
-                        time.Sleep(failedTxReceiptRestartDelay)
-                        u.process()
-                    }
-                    txChecks++
-                }
-            
-            minersPaid++
-            totalAmount.Add(totalAmount, big.NewInt(amount))
-            log.Printf("Paid %v ETP to %v, Tx: %v", amount, login, txHash)
-        }
+    mustPay, paid := u.payBatches(payees, u.backend.GetBalance, u.payBatch)
+    minersPaid := len(paid)
+    totalAmount := big.NewInt(0)
+    for _, payment := range paid {
+        totalAmount.Add(totalAmount, big.NewInt(payment.Amount))
+    }
 
     if mustPay > 0 {
         log.Printf("Paid total %v ETP to %v of %v payees", totalAmount, minersPaid, mustPay)
@@ -229,7 +176,143 @@ func (u *PayoutsProcessor) process() {
     }
 }
 
-func (self PayoutsProcessor) checkPeers() bool {
+// Pays payees over threshold in batches of up to batchSize in payees order,
+// stops at the first failed batch or on shutdown. Returns number of payees over threshold and payments made.
+func (u *PayoutsProcessor) payBatches(payees []string, balance func(string) (int64, error),
+    pay func([]*storage.PendingPayment) bool) (int, []*storage.PendingPayment) {
+    mustPay := 0
+    var paid, batch []*storage.PendingPayment
+    for i, login := range payees {
+        amount, _ := balance(login)
+        if u.reachedThreshold(big.NewInt(amount)) {
+            mustPay++
+            batch = append(batch, &storage.PendingPayment{Address: login, Amount: amount})
+        }
+        if len(batch) == 0 || (len(batch) < u.batchSize && i < len(payees)-1) {
+            continue
+        }
+        // Never interrupt between lock and logged payment
+        if u.stopped() {
+            log.Println("Payouts interrupted by shutdown, remaining payees will be paid on next run")
+            break
+        }
+        if !pay(batch) {
+            break
+        }
+        paid = append(paid, batch...)
+        batch = nil
+    }
+    return mustPay, paid
+}
+
+// Pays batch in one transaction, returns false if payouts must not continue
+func (u *PayoutsProcessor) payBatch(batch []*storage.PendingPayment) bool {
+    batchAmount := big.NewInt(0)
+    receivers := make([]string, len(batch))
+    for i, payment := range batch {
+        batchAmount.Add(batchAmount, big.NewInt(payment.Amount))
+        receivers[i] = fmt.Sprintf("%s:%v", payment.Address, payment.Amount)
+    }
+
+    // Require active peers before processing
+    if !u.checkPeers() {
+        log.Println("Insufficient peers for payment... Will delay until next run.")
+        return false
+    }
+
+    // Check if we have enough funds
+    var getBalance *rpc.GetBalanceReply
+    err := retry(u.quit, "Retrieving pool balance", func() error {
+        var err error
+        getBalance, err = u.rpc.GetBalance(u.config.Address)
+        return err
+    })
+    if err != nil {
+        log.Println("Unable to get pool balance from node, will retry on next run:", err)
+        return false
+    }
+    poolBalance := big.NewInt(getBalance.Unspent)
+
+    if poolBalance.Cmp(batchAmount) < 0 {
+        err := fmt.Errorf("Not enough balance for payment, need %s Satoshi, pool has %s Satoshi",
+            batchAmount.String(), poolBalance.String())
+        u.haltOn(err)
+        return false
+    }
+
+    // Lock payments for current payout
+    err = u.backend.LockPayouts(batch)
+    if err != nil {
+        log.Printf("Failed to lock payment for %v payees: %v", len(batch), err)
+        u.haltOn(err)
+        return false
+    }
+    log.Printf("Locked payment for %v payees, %v Satoshi", len(batch), batchAmount)
+
+    // Debit miners' balances and log pending payment
+    err = u.backend.UpdateBalance(batch)
+    if err != nil {
+        log.Printf("Failed to update balance for %v payees, %v Satoshi: %v", len(batch), batchAmount, err)
+        u.haltOn(err)
+        return false
+    }
+    log.Printf("Balance updated for %v payees, %v Satoshi", len(batch), batchAmount)
+
+    txHash, err := u.rpc.SendMore(u.config.Address, receivers)
+    if err != nil || txHash == "" {
+        log.Printf("Failed to send payment to %v payees, %v Satoshi: %v. Check outgoing tx in block explorer and docs/PAYOUTS.md",
+            len(batch), batchAmount, err)
+        if err == nil {
+            err = fmt.Errorf("Empty transaction hash of payment to %v payees", len(batch))
+        }
+        u.haltOn(err)
+        return false
+    }
+
+    // Log transaction hash for every payee at once, pending payment must never be credited back once tx is sent
+    err = u.backend.WritePayment(txHash, batch)
+    if err != nil {
+        log.Printf("Failed to log payment for %v payees, Satoshi: %v, Tx: %s [%v]", len(batch), batchAmount, txHash, err)
+        u.haltOn(err)
+        return false
+    }
+    for _, payment := range batch {
+        log.Printf("Paid %v ETP to %v, Tx: %v", payment.Amount, payment.Address, txHash)
+    }
+
+    // Wait for TX confirmation before further payouts, payment is logged already so shutdown may interrupt it
+    if !u.waitForTx(txHash) {
+        if u.stopped() {
+            log.Printf("Payouts interrupted by shutdown while waiting for TxReceipt %s, check it in block explorer", txHash)
+        } else {
+            err := fmt.Errorf("Transaction %s to %v payees is not confirmed after %v checks", txHash, len(batch), maxTxChecks)
+            log.Printf("%v. Check it in block explorer and docs/PAYOUTS.md", err)
+            u.haltOn(err)
+        }
+        return false
+    }
+    log.Printf("TxReceipt confirmed for %v payees: Satoshi: %v, Tx: %s", len(batch), batchAmount, txHash)
+    return true
+}
+
+// Polls node until transaction is confirmed, returns false if it's not confirmed in time or on shutdown
+func (u *PayoutsProcessor) waitForTx(txHash string) bool {
+    for i := 0; i < maxTxChecks; i++ {
+        log.Printf("Waiting for TxReceipt: %v", txHash)
+        select {
+        case <-time.After(txCheckInterval):
+        case <-u.quit:
+            return false
+        }
+        receipt, err := u.rpc.GetTransaction(txHash)
+        if err == nil && receipt != nil && receipt.Confirmed() && txHash == receipt.Hash {
+            return true
+        }
+    }
+    return false
+}
+
+func (self *PayoutsProcessor) checkPeers() bool {
     peers, err := self.rpc.GetPeerCount()
     if err != nil {
         log.Println("Unable to start payouts, failed to retrieve number of peers from node:", err)
@@ -242,7 +325,7 @@ func (self PayoutsProcessor) checkPeers() bool {
     return true
 }
 
-func (self PayoutsProcessor) reachedThreshold(amount *big.Int) bool {
+func (self *PayoutsProcessor) reachedThreshold(amount *big.Int) bool {
     return big.NewInt(self.config.Threshold).Cmp(amount) < 0
 }
 
@@ -254,7 +337,7 @@ func formatPendingPayments(list []*storage.PendingPayment) string {
     return s
 }
 
-func (self PayoutsProcessor) bgSave() {
+func (self *PayoutsProcessor) bgSave() {
     result, err := self.backend.BgSave()
     if err != nil {
         log.Println("Failed to perform BGSAVE on backend:", err)
@@ -263,21 +346,21 @@ func (self PayoutsProcessor) bgSave() {
     log.Println("Saving backend state to disk:", result)
 }
 
-func (self PayoutsProcessor) resolvePayouts() {
+func (self *PayoutsProcessor) resolvePayouts() {
     payments := self.backend.GetPendingPayments()
 
     if len(payments) > 0 {
         log.Printf("Will credit back following balances:\n%s", formatPendingPayments(payments))
 
+        err := self.backend.RollbackBalance(payments)
+        if err != nil {
+            log.Printf("Failed to credit balances back, error is: %v", err)
+            return
+        }
         for _, v := range payments {
-            err := self.backend.RollbackBalance(v.Address, v.Amount)
-            if err != nil {
-                log.Printf("Failed to credit %v Satoshi back to %s, error is: %v", v.Amount, v.Address, err)
-                return
-            }
             log.Printf("Credited %v Satoshi back to %s", v.Amount, v.Address)
         }
-        err := self.backend.UnlockPayouts()
+        err = self.backend.UnlockPayouts()
         if err != nil {
             log.Println("Failed to unlock payouts:", err)
             return
@@ -292,7 +375,7 @@ func (self PayoutsProcessor) resolvePayouts() {
     log.Println("Payouts unlocked")
 }
 
-func (self PayoutsProcessor) mustResolvePayout() bool {
+func (self *PayoutsProcessor) mustResolvePayout() bool {
     v, _ := strconv.ParseBool(os.Getenv("RESOLVE_PAYOUT"))
     return v
 }
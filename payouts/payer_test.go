@@ -0,0 +1,80 @@
+package payouts
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/storage"
+)
+
+// Payees e and b are at or below threshold of 100
+var testBalances = map[string]int64{"a": 500, "b": 50, "c": 200, "d": 300, "e": 100, "f": 700}
+
+func testBalance(login string) (int64, error) {
+    return testBalances[login], nil
+}
+
+// Records paid batches as comma separated logins, fails or stops payouts on given batch
+type testPayer struct {
+    u         *PayoutsProcessor
+    batches   []string
+    failOn    int
+    stopOn    int
+}
+
+func (p *testPayer) pay(batch []*storage.PendingPayment) bool {
+    logins := make([]string, len(batch))
+    for i, payment := range batch {
+        logins[i] = payment.Address
+    }
+    p.batches = append(p.batches, strings.Join(logins, ","))
+    if len(p.batches) == p.stopOn {
+        close(p.u.quit)
+    }
+    return len(p.batches) != p.failOn
+}
+
+func TestPayBatches(t *testing.T) {
+    tests := []struct {
+        name      string
+        payees    []string
+        batchSize int
+        failOn    int
+        stopOn    int
+        batches   []string
+        mustPay   int
+        paid      int
+    }{
+        {"full batches", []string{"a", "b", "c", "d", "e", "f"}, 2, 0, 0, []string{"a,c", "d,f"}, 4, 4},
+        {"partial last batch", []string{"a", "b", "c", "d", "e", "f"}, 3, 0, 0, []string{"a,c,d", "f"}, 4, 4},
+        {"last payee below threshold", []string{"a", "c", "d", "f", "e", "b"}, 3, 0, 0, []string{"a,c,d", "f"}, 4, 4},
+        {"single batch", []string{"a", "b", "c", "d", "e", "f"}, 20, 0, 0, []string{"a,c,d,f"}, 4, 4},
+        {"one payee per batch", []string{"e", "a", "b", "f"}, 1, 0, 0, []string{"a", "f"}, 2, 2},
+        {"nobody over threshold", []string{"b", "e"}, 2, 0, 0, nil, 0, 0},
+        {"no payees", nil, 2, 0, 0, nil, 0, 0},
+        {"failed batch stops payouts", []string{"a", "b", "c", "d", "e", "f"}, 1, 2, 0, []string{"a", "c"}, 2, 1},
+        {"stop between batches", []string{"a", "b", "c", "d", "e", "f"}, 2, 0, 1, []string{"a,c"}, 4, 2},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            u := &PayoutsProcessor{
+                config:    &PayoutsConfig{Threshold: 100},
+                batchSize: tt.batchSize,
+                quit:      make(chan struct{}),
+            }
+            p := &testPayer{u: u, failOn: tt.failOn, stopOn: tt.stopOn}
+            mustPay, paid := u.payBatches(tt.payees, testBalance, p.pay)
+
+            if !reflect.DeepEqual(p.batches, tt.batches) {
+                t.Errorf("paid batches %q, want %q", p.batches, tt.batches)
+            }
+            if mustPay != tt.mustPay {
+                t.Errorf("mustPay = %v, want %v", mustPay, tt.mustPay)
+            }
+            if len(paid) != tt.paid {
+                t.Errorf("%v payments made, want %v", len(paid), tt.paid)
+            }
+        })
+    }
+}
@@ -0,0 +1,152 @@
+package payouts
+
+import (
+    "fmt"
+    "log"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/rpc"
+    "github.com/NotoriousPyro/open-metaverse-pool/storage"
+    "github.com/NotoriousPyro/open-metaverse-pool/util"
+)
+
+const defaultReorgBlocks = 100
+
+type ReorgConfig struct {
+    Enabled          bool     `json:"enabled"`
+    Interval         string   `json:"interval"`
+    // Number of the most recent matured blocks to check
+    Blocks           int64    `json:"blocks"`
+    Daemon           string   `json:"daemon"`
+    Timeout          string   `json:"timeout"`
+    Account          string
+    Password         string
+}
+
+// Checks that already credited blocks are still in chain, reorg deeper than unlocker depth halts payouts
+type ReorgWatcher struct {
+    config        *ReorgConfig
+    backend       *storage.RedisClient
+    rpc           *rpc.RPCClient
+    blocks        int64
+    quit          chan struct{}
+    // Held during check, so Stop can wait for it
+    runMu         sync.Mutex
+}
+
+func NewReorgWatcher(cfg *ReorgConfig, backend *storage.RedisClient) *ReorgWatcher {
+    w := &ReorgWatcher{config: cfg, backend: backend, blocks: defaultReorgBlocks, quit: make(chan struct{})}
+    if cfg.Blocks > 0 {
+        w.blocks = cfg.Blocks
+    }
+    w.rpc = rpc.NewRPCClient("ReorgWatcher", cfg.Daemon, cfg.Account, cfg.Password, cfg.Timeout)
+    return w
+}
+
+func (w *ReorgWatcher) Start() {
+    log.Println("Starting reorg watcher")
+    intv := util.MustParseDuration(w.config.Interval)
+    timer := time.NewTimer(intv)
+    log.Printf("Set reorg check interval to %v for last %v matured blocks", intv, w.blocks)
+
+    // Immediately check after start
+    w.run()
+    timer.Reset(intv)
+
+    go func() {
+        for {
+            select {
+            case <-timer.C:
+                w.run()
+                timer.Reset(intv)
+            case <-w.quit:
+                timer.Stop()
+                return
+            }
+        }
+    }()
+}
+
+func (w *ReorgWatcher) Stop() {
+    close(w.quit)
+    w.runMu.Lock()
+    w.runMu.Unlock()
+    log.Println("Reorg watcher stopped")
+}
+
+func (w *ReorgWatcher) stopped() bool {
+    select {
+    case <-w.quit:
+        return true
+    default:
+        return false
+    }
+}
+
+func (w *ReorgWatcher) run() {
+    w.runMu.Lock()
+    defer w.runMu.Unlock()
+    if w.stopped() {
+        return
+    }
+    w.checkMaturedBlocks()
+}
+
+func (w *ReorgWatcher) checkMaturedBlocks() {
+    blocks, err := w.backend.GetMaturedBlocks(w.blocks)
+    if err != nil {
+        log.Printf("Failed to get matured blocks from backend: %v", err)
+        return
+    }
+
+    reorged := 0
+    for _, block := range blocks {
+        if w.stopped() {
+            return
+        }
+        // Orphans were never credited and uncles aren't at their own height
+        if block.Orphan || block.Uncle {
+            continue
+        }
+        current, err := w.rpc.GetBlockByHeight(block.Height)
+        if err != nil {
+            log.Printf("Error while retrieving block %v from node: %v", block.Height, err)
+            return
+        }
+        if current == nil {
+            log.Printf("Error while retrieving block %v from node, wrong node height", block.Height)
+            return
+        }
+        if strings.EqualFold(current.Hash, block.Hash) {
+            continue
+        }
+        reorged++
+
+        credits, reserve, flagged, err := w.backend.WriteReorg(block, current.Hash, PayoutsModule)
+        if err != nil {
+            log.Printf("Failed to flag reorged block %v:%v: %v", block.Height, block.Hash, err)
+            return
+        }
+        if !flagged {
+            continue
+        }
+        entries := []string{fmt.Sprintf(
+            "REORG %v: credited block %v replaced by %v, payouts halted, credits to reverse:",
+            block.Height, block.Hash, current.Hash,
+        )}
+        for login, amount := range credits {
+            entries = append(entries, fmt.Sprintf("\tREVERSE %v:%v: %v: %v Shannon", block.Height, block.Hash, login, amount))
+        }
+        if reserve > 0 {
+            entries = append(entries, fmt.Sprintf("\tREVERSE %v:%v: PPS reserve: %v Shannon", block.Height, block.Hash, reserve))
+        }
+        log.Println(strings.Join(entries, "\n"))
+    }
+    if reorged > 0 {
+        log.Printf("%v of last %v matured blocks are no longer in chain", reorged, len(blocks))
+    } else {
+        log.Printf("Last %v matured blocks are still in chain", len(blocks))
+    }
+}
@@ -3,12 +3,13 @@ package payouts
 import (
     "fmt"
     "log"
-    "math"
     "math/big"
     "strconv"
     "strings"
+    "sync"
     "time"
 
+    "github.com/NotoriousPyro/open-metaverse-pool/reward"
     "github.com/NotoriousPyro/open-metaverse-pool/rpc"
     "github.com/NotoriousPyro/open-metaverse-pool/storage"
     "github.com/NotoriousPyro/open-metaverse-pool/util"
@@ -17,6 +18,7 @@ import (
 type UnlockerConfig struct {
     Enabled          bool     `json:"enabled"`
     PoolFee          float64  `json:"poolFee"`
+    SoloFee          float64  `json:"soloFee"`
     Donate           bool     `json:"donate"`
     Depth            int64    `json:"depth"`
     ImmatureDepth    int64    `json:"immatureDepth"`
@@ -28,16 +30,39 @@ type UnlockerConfig struct {
     Password         string
     Address          string   `json:"address"`
     PoolFeeAddress   string   `json:"poolFeeAddress"`
+    PPLNS            PPLNSConfig  `json:"pplns"`
+    // Proxies pay miners per share, pooled blocks are credited to pool reserve
+    PPS              bool     `json:"pps"`
+    // Taken from rewardSchedule shared with proxies
+    RewardSchedule   reward.Schedule
+}
+
+// Pays each pooled block to the last window of share difficulty before it was found,
+// window is either fixed or a multiple of network difficulty at block height
+type PPLNSConfig struct {
+    Enabled          bool     `json:"enabled"`
+    Window           int64    `json:"window"`
+    WindowFactor     float64  `json:"windowFactor"`
 }
 
 const minDepth = 16
 
+// Number of recent blocks reward schedule is checked against on startup
+const rewardCheckBlocks = 10
+
+// Share log is trimmed keeping this many windows, so difficulty rise before next block is covered
+const shareLogMargin = 2
+
 type BlockUnlocker struct {
     config        *UnlockerConfig
     backend       *storage.RedisClient
     rpc           *rpc.RPCClient
-    halt          bool
-    lastFail      error
+    // Unix time payout scheme is in effect since
+    schemeSince   int64
+    haltState
+    quit          chan struct{}
+    // Held during unlocking session, so Stop can wait for it
+    runMu         sync.Mutex
 }
 
 func NewBlockUnlocker(cfg *UnlockerConfig, backend *storage.RedisClient) *BlockUnlocker {
@@ -47,13 +72,26 @@ func NewBlockUnlocker(cfg *UnlockerConfig, backend *storage.RedisClient) *BlockU
     if cfg.ImmatureDepth < minDepth {
         log.Fatalf("Immature depth can't be < %v, your depth is %v", minDepth, cfg.ImmatureDepth)
     }
-    u := &BlockUnlocker{config: cfg, backend: backend}
+    u := &BlockUnlocker{config: cfg, backend: backend, quit: make(chan struct{})}
+    u.haltState = haltState{module: UnlockerModule, backend: backend}
     if len(cfg.PoolFeeAddress) != 0 && !util.IsValidHexAddress(cfg.PoolFeeAddress) {
         log.Fatalln("Invalid poolFeeAddress", cfg.PoolFeeAddress)
     }
     if len(cfg.PoolFeeAddress) < 1 {
         log.Fatalln("poolFeeAddress not set in config", cfg.PoolFeeAddress)
     }
+    if cfg.PPLNS.Enabled && cfg.PPLNS.Window <= 0 && cfg.PPLNS.WindowFactor <= 0 {
+        log.Fatalln("PPLNS window or windowFactor must be set")
+    }
+    if cfg.PPLNS.Enabled && cfg.PPS {
+        log.Fatalln("PPLNS and PPS can't be enabled at once")
+    }
+    if err := cfg.RewardSchedule.Check(); err != nil {
+        log.Fatalln(err)
+    }
+    if cfg.RewardSchedule.Source == reward.SourceCoinbase && cfg.KeepTxFees {
+        log.Println("Transaction fees can't be kept with coinbase reward schedule, they are paid to miners")
+    }
     u.rpc = rpc.NewRPCClient("BlockUnlocker", cfg.Daemon, cfg.Account, cfg.Password, cfg.Timeout)
     return u
 }
@@ -63,24 +101,60 @@ func (u *BlockUnlocker) Start() {
     intv := util.MustParseDuration(u.config.Interval)
     timer := time.NewTimer(intv)
     log.Printf("Set block unlock interval to %v", intv)
+    u.claimPayoutScheme()
+    u.checkRewardSchedule()
 
     // Immediately unlock after start
-    u.unlockPendingBlocks()
-    u.unlockAndCreditMiners()
+    u.run()
     timer.Reset(intv)
 
     go func() {
         for {
             select {
             case <-timer.C:
-                u.unlockPendingBlocks()
-                u.unlockAndCreditMiners()
+                u.run()
                 timer.Reset(intv)
+            case <-u.quit:
+                timer.Stop()
+                return
             }
         }
     }()
 }
 
+// Waits for current unlocking session to reach a safe checkpoint and prevents further sessions
+func (u *BlockUnlocker) Stop() {
+    close(u.quit)
+    u.runMu.Lock()
+    u.runMu.Unlock()
+    log.Println("Block unlocker stopped")
+}
+
+func (u *BlockUnlocker) stopped() bool {
+    select {
+    case <-u.quit:
+        return true
+    default:
+        return false
+    }
+}
+
+func (u *BlockUnlocker) run() {
+    u.runMu.Lock()
+    defer u.runMu.Unlock()
+    if u.stopped() {
+        return
+    }
+    u.unlockPendingBlocks()
+    if u.stopped() {
+        return
+    }
+    u.unlockAndCreditMiners()
+    if u.config.PPLNS.Enabled && !u.stopped() {
+        u.trimShareLog()
+    }
+}
+
 type UnlockResult struct {
     maturedBlocks   []*storage.BlockData
     orphanedBlocks  []*storage.BlockData
@@ -95,22 +169,17 @@ func (u *BlockUnlocker) unlockCandidates(candidates []*storage.BlockData) (*Unlo
     // Data row is: "height:nonce:powHash:mixDigest:timestamp:diff:totalShares"
     for _, candidate := range candidates {
         height := candidate.Height
-        block, err := u.rpc.GetBlockByHeight(height)
+        block, err := u.getBlockByHeight(height)
         if err != nil {
             log.Printf("Error while retrieving block %v from node: %v", height, err)
             return nil, err
         }
-        if block == nil {
-            return nil, fmt.Errorf("Error while retrieving block %v from node, wrong node height", height)
-        }
         
         if u.matchCandidate(block, candidate) {
             result.blocks++
 
             err = u.handleBlock(block, candidate)
             if err != nil {
-                u.halt = true
-                u.lastFail = err
                 return nil, err
             }
             result.maturedBlocks = append(result.maturedBlocks, candidate)
@@ -143,8 +212,17 @@ func (u *BlockUnlocker) matchCandidate(block *rpc.GetBlockReply, candidate *stor
 }
 
 func (u *BlockUnlocker) handleBlock(block *rpc.GetBlockReply, candidate *storage.BlockData) error {
-    reward := big.NewInt(int64(300000000 * math.Pow(0.95, math.Floor(float64(block.Number*1.0)/500000))))
-    extraTxReward, _ := u.getExtraRewardForTx(block.Number, reward)
+    coinbase, err := u.getCoinbaseValue(block.Number)
+    if err != nil {
+        return err
+    }
+    reward, ok := u.config.RewardSchedule.BlockReward(block.Number)
+    extraTxReward := new(big.Int)
+    if !ok {
+        reward = coinbase
+    } else {
+        extraTxReward.Sub(coinbase, reward)
+    }
     
     if u.config.KeepTxFees {
         candidate.ExtraReward = extraTxReward
@@ -160,23 +238,18 @@ func (u *BlockUnlocker) handleBlock(block *rpc.GetBlockReply, candidate *storage
 }
 
 func (u *BlockUnlocker) unlockPendingBlocks() {
-    if u.halt {
-        log.Println("Unlocking suspended due to last critical error:", u.lastFail)
+    if u.halted() {
         return
     }
 
-    current, err := u.rpc.GetPendingBlock()
+    current, err := u.getPendingBlock()
     if err != nil {
-        u.halt = true
-        u.lastFail = err
         log.Printf("Unable to get current blockchain height from node: %v", err)
         return
     }
 
     candidates, err := u.backend.GetCandidates(int64(current.Number) - u.config.ImmatureDepth)
     if err != nil {
-        u.halt = true
-        u.lastFail = err
         log.Printf("Failed to get block candidates from backend: %v", err)
         return
     }
@@ -188,8 +261,6 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
     
     result, err := u.unlockCandidates(candidates)
     if err != nil {
-        u.halt = true
-        u.lastFail = err
         log.Printf("Failed to unlock blocks: %v", err)
         return
     }
@@ -197,8 +268,7 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
 
     err = u.backend.WritePendingOrphans(result.orphanedBlocks)
     if err != nil {
-        u.halt = true
-        u.lastFail = err
+        u.haltOn(err)
         log.Printf("Failed to insert orphaned blocks into backend: %v", err)
         return
     } else {
@@ -210,17 +280,19 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
     totalPoolProfit := new(big.Rat)
 
     for _, block := range result.maturedBlocks {
+        if u.stopped() {
+            log.Println("Unlocking interrupted by shutdown, remaining blocks will be processed on next run")
+            return
+        }
         revenue, minersProfit, poolProfit, roundRewards, err := u.calculateRewards(block)
         if err != nil {
-            u.halt = true
-            u.lastFail = err
+            u.haltOn(err)
             log.Printf("Failed to calculate rewards for round %v: %v", block.RoundKey(), err)
             return
         }
         err = u.backend.WriteImmatureBlock(block, roundRewards)
         if err != nil {
-            u.halt = true
-            u.lastFail = err
+            u.haltOn(err)
             log.Printf("Failed to credit rewards for round %v: %v", block.RoundKey(), err)
             return
         }
@@ -251,23 +323,18 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
 }
 
 func (u *BlockUnlocker) unlockAndCreditMiners() {
-    if u.halt {
-        log.Println("Unlocking suspended due to last critical error:", u.lastFail)
+    if u.halted() {
         return
     }
     
-    current, err := u.rpc.GetPendingBlock()
+    current, err := u.getPendingBlock()
     if err != nil {
-        u.halt = true
-        u.lastFail = err
         log.Printf("Unable to get current blockchain height from node: %v", err)
         return
     }
     
     immature, err := u.backend.GetImmatureBlocks(int64(current.Number) - u.config.Depth)
     if err != nil {
-        u.halt = true
-        u.lastFail = err
         log.Printf("Failed to get block candidates from backend: %v", err)
         return
     }
@@ -279,8 +346,6 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 
     result, err := u.unlockCandidates(immature)
     if err != nil {
-        u.halt = true
-        u.lastFail = err
         log.Printf("Failed to unlock blocks: %v", err)
         return
     }
@@ -289,8 +354,7 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
     for _, block := range result.orphanedBlocks {
         err = u.backend.WriteOrphan(block)
         if err != nil {
-            u.halt = true
-            u.lastFail = err
+            u.haltOn(err)
             log.Printf("Failed to insert orphaned block into backend: %v", err)
             return
         }
@@ -302,17 +366,23 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
     totalPoolProfit := new(big.Rat)
 
     for _, block := range result.maturedBlocks {
+        if u.stopped() {
+            log.Println("Crediting interrupted by shutdown, remaining blocks will be processed on next run")
+            return
+        }
         revenue, minersProfit, poolProfit, roundRewards, err := u.calculateRewards(block)
         if err != nil {
-            u.halt = true
-            u.lastFail = err
+            u.haltOn(err)
             log.Printf("Failed to calculate rewards for round %v: %v", block.RoundKey(), err)
             return
         }
-        err = u.backend.WriteMaturedBlock(block, roundRewards)
+        reserve := int64(0)
+        if u.config.PPS && !block.Solo {
+            reserve, _ = strconv.ParseInt(minersProfit.FloatString(0), 10, 64)
+        }
+        err = u.backend.WriteMaturedBlock(block, roundRewards, reserve)
         if err != nil {
-            u.halt = true
-            u.lastFail = err
+            u.haltOn(err)
             log.Printf("Failed to credit rewards for round %v: %v", block.RoundKey(), err)
             return
         }
@@ -344,15 +414,27 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 
 func (u *BlockUnlocker) calculateRewards(block *storage.BlockData) (*big.Rat, *big.Rat, *big.Rat, map[string]int64, error) {
     revenue := new(big.Rat).SetInt(block.Reward)
-    minersProfit, poolProfit := chargeFee(revenue, u.config.PoolFee)
-
-    shares, err := u.backend.GetRoundShares(block.RoundHeight, block.Nonce)
-    if err != nil {
-        return nil, nil, nil, nil, err
+    var minersProfit, poolProfit *big.Rat
+    var rewards map[string]int64
+
+    if block.Solo {
+        // Whole reward goes to finder, round shares are kept for stats only
+        minersProfit, poolProfit = chargeFee(revenue, u.config.SoloFee)
+        reward, _ := strconv.ParseInt(minersProfit.FloatString(0), 10, 64)
+        rewards = map[string]int64{block.Finder: reward}
+    } else if u.config.PPS {
+        // Miners were paid per share already, miners profit refills pool reserve
+        minersProfit, poolProfit = new(big.Rat).Set(revenue), new(big.Rat)
+        rewards = make(map[string]int64)
+    } else {
+        minersProfit, poolProfit = chargeFee(revenue, u.config.PoolFee)
+        shares, total, err := u.roundShares(block)
+        if err != nil {
+            return nil, nil, nil, nil, err
+        }
+        rewards = calculateRewardsForShares(shares, total, minersProfit)
     }
 
-    rewards := calculateRewardsForShares(shares, block.TotalShares, minersProfit)
-
     if block.ExtraReward != nil {
         extraReward := new(big.Rat).SetInt(block.ExtraReward)
         poolProfit.Add(poolProfit, extraReward)
@@ -368,6 +450,94 @@ func (u *BlockUnlocker) calculateRewards(block *storage.BlockData) (*big.Rat, *b
     return revenue, minersProfit, poolProfit, rewards, nil
 }
 
+// Returns shares block is paid for and their total
+func (u *BlockUnlocker) roundShares(block *storage.BlockData) (map[string]int64, int64, error) {
+    if u.config.PPLNS.Enabled {
+        shares, total, found, err := u.backend.GetPPLNSShares(block.Nonce, u.pplnsWindow(block.Difficulty))
+        if err != nil {
+            return nil, 0, err
+        }
+        if found && total > 0 {
+            return shares, total, nil
+        }
+        if block.Timestamp >= u.schemeSince {
+            return nil, 0, fmt.Errorf("Round %v is not in share log, proxies must run with shareLog", block.RoundKey())
+        }
+        // Block found before PPLNS was enabled
+        log.Printf("Round %v is not in share log, paying proportionally", block.RoundKey())
+    }
+    shares, err := u.backend.GetRoundShares(block.RoundHeight, block.Nonce)
+    if err != nil {
+        return nil, 0, err
+    }
+    return shares, block.TotalShares, nil
+}
+
+// Proxies and unlocker must agree on payout scheme, the first one started sets it in backend
+func (u *BlockUnlocker) claimPayoutScheme() {
+    scheme := storage.SchemeProp
+    if u.config.PPS {
+        scheme = storage.SchemePPS
+    } else if u.config.PPLNS.Enabled {
+        scheme = storage.SchemePPLNS
+    }
+    current, since, err := u.backend.ClaimPayoutScheme(scheme)
+    if err != nil {
+        log.Fatalf("Unable to check payout scheme in backend: %v", err)
+    }
+    if current != scheme {
+        log.Fatalf("Unlocker pays %s, but backend is set to %s, see docs/PAYOUTS.md to switch", scheme, current)
+    }
+    u.schemeSince = since
+    log.Printf("Paying %s since %v", scheme, time.Unix(since, 0))
+}
+
+func (u *BlockUnlocker) pplnsWindow(networkDiff int64) int64 {
+    if u.config.PPLNS.Window > 0 {
+        return u.config.PPLNS.Window
+    }
+    return int64(float64(networkDiff) * u.config.PPLNS.WindowFactor)
+}
+
+// Drops shares which neither pending blocks nor the next block can be paid for
+func (u *BlockUnlocker) trimShareLog() {
+    current, err := u.getPendingBlock()
+    if err != nil {
+        log.Printf("Unable to get current blockchain difficulty from node: %v", err)
+        return
+    }
+    networkDiff, ok := new(big.Int).SetString(current.Difficulty, 10)
+    if !ok {
+        log.Printf("Unable to parse current blockchain difficulty %v", current.Difficulty)
+        return
+    }
+    blocks, err := u.backend.GetShareLogBlocks()
+    if err != nil {
+        log.Printf("Failed to get pending blocks from share log: %v", err)
+        return
+    }
+
+    // Windows of later blocks end later, so the oldest block with the widest window covers them all
+    until := util.MakeTimestamp()
+    window := u.pplnsWindow(networkDiff.Int64())
+    for _, block := range blocks {
+        if block.Timestamp < until {
+            until = block.Timestamp
+        }
+        if w := u.pplnsWindow(block.Difficulty); w > window {
+            window = w
+        }
+    }
+    n, err := u.backend.TrimShareLog(until, window*shareLogMargin)
+    if err != nil {
+        log.Printf("Failed to trim share log: %v", err)
+        return
+    }
+    if n > 0 {
+        log.Printf("Trimmed %v shares from share log", n)
+    }
+}
+
 func calculateRewardsForShares(shares map[string]int64, total int64, reward *big.Rat) map[string]int64 {
     rewards := make(map[string]int64)
 
@@ -389,17 +559,74 @@ func chargeFee(value *big.Rat, fee float64) (*big.Rat, *big.Rat) {
     return new(big.Rat).Sub(value, feeValue), feeValue
 }
 
-func (u *BlockUnlocker) getExtraRewardForTx(height uint64, reward *big.Int) (*big.Int, error) {
-    BlockTxs, err := u.rpc.GetBlockTxs(height)
+func (u *BlockUnlocker) getPendingBlock() (*rpc.GetBlockReply, error) {
+    var block *rpc.GetBlockReply
+    err := retry(u.quit, "Retrieving pending block", func() error {
+        var err error
+        block, err = u.rpc.GetPendingBlock()
+        return err
+    })
+    return block, err
+}
+
+func (u *BlockUnlocker) getBlockByHeight(height int64) (*rpc.GetBlockReply, error) {
+    var block *rpc.GetBlockReply
+    err := retry(u.quit, fmt.Sprintf("Retrieving block %v", height), func() error {
+        var err error
+        block, err = u.rpc.GetBlockByHeight(height)
+        if err == nil && block == nil {
+            err = fmt.Errorf("Block %v not found, wrong node height", height)
+        }
+        return err
+    })
+    return block, err
+}
+
+func (u *BlockUnlocker) getCoinbaseValue(height uint64) (*big.Int, error) {
+    var blockTxs *rpc.GetBlockReply
+    err := retry(u.quit, fmt.Sprintf("Retrieving BlockTxs for height %v", height), func() error {
+        var err error
+        blockTxs, err = u.rpc.GetBlockTxs(height)
+        return err
+    })
     if err != nil {
         log.Printf("Error retrieving BlockTxs for height %v", height)
         return nil, err
     }
-    
-    blockValue := big.NewInt(BlockTxs.Transactions[0].Outputs[0].Value)
+    return reward.CoinbaseValue(blockTxs)
+}
+
+// Warns if configured rewards disagree with coinbases of recent blocks
+func (u *BlockUnlocker) checkRewardSchedule() {
+    schedule := &u.config.RewardSchedule
+    if _, ok := schedule.BlockReward(0); !ok {
+        return
+    }
+    current, err := u.getPendingBlock()
     if err != nil {
-        return nil, err
+        log.Printf("Unable to check reward schedule, failed to get current blockchain height: %v", err)
+        return
     }
-    
-    return new(big.Int).Sub(blockValue, reward), nil
-}
\ No newline at end of file
+
+    matched := 0
+    checked := 0
+    for height := current.Number - 1; height > 0 && height < current.Number && checked < rewardCheckBlocks; height-- {
+        coinbase, err := u.getCoinbaseValue(height)
+        if err != nil {
+            log.Printf("Unable to check reward schedule at height %v: %v", height, err)
+            return
+        }
+        checked++
+        reward, _ := schedule.BlockReward(height)
+        switch coinbase.Cmp(reward) {
+        case -1:
+            log.Printf("WARNING: Reward schedule gives %v at height %v, but coinbase is only %v", reward, height, coinbase)
+        case 0:
+            matched++
+        }
+    }
+    // Coinbase above reward is counted as transaction fees, it's suspicious if no block is without fees
+    if checked > 0 && matched == 0 {
+        log.Printf("WARNING: None of %v recent coinbases equals scheduled reward, schedule may be too low", checked)
+    }
+}
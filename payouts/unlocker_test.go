@@ -0,0 +1,54 @@
+package payouts
+
+import (
+    "math/big"
+    "reflect"
+    "testing"
+)
+
+func TestPPLNSWindow(t *testing.T) {
+    tests := []struct {
+        name      string
+        config    PPLNSConfig
+        diff      int64
+        expected  int64
+    }{
+        {"fixed window", PPLNSConfig{Enabled: true, Window: 5000}, 1000000, 5000},
+        {"fixed window wins over factor", PPLNSConfig{Enabled: true, Window: 5000, WindowFactor: 2}, 1000000, 5000},
+        {"factor of network difficulty", PPLNSConfig{Enabled: true, WindowFactor: 2}, 1000000, 2000000},
+        {"fractional factor", PPLNSConfig{Enabled: true, WindowFactor: 0.5}, 1000001, 500000},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            u := &BlockUnlocker{config: &UnlockerConfig{PPLNS: tt.config}}
+            if got := u.pplnsWindow(tt.diff); got != tt.expected {
+                t.Errorf("pplnsWindow(%v) = %v, want %v", tt.diff, got, tt.expected)
+            }
+        })
+    }
+}
+
+func TestCalculateRewardsForShares(t *testing.T) {
+    alice := "MAaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+    bob := "MBbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+    tests := []struct {
+        name      string
+        shares    map[string]int64
+        total     int64
+        reward    int64
+        expected  map[string]int64
+    }{
+        {"single miner", map[string]int64{alice: 100}, 100, 1000, map[string]int64{alice: 1000}},
+        {"proportional", map[string]int64{alice: 300, bob: 100}, 400, 1000, map[string]int64{alice: 750, bob: 250}},
+        {"rounding", map[string]int64{alice: 50, bob: 50}, 100, 999, map[string]int64{alice: 500, bob: 500}},
+        {"invalid login", map[string]int64{alice: 50, "0xdeadbeef": 50}, 100, 1000, map[string]int64{alice: 500}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got := calculateRewardsForShares(tt.shares, tt.total, new(big.Rat).SetInt64(tt.reward))
+            if !reflect.DeepEqual(got, tt.expected) {
+                t.Errorf("calculateRewardsForShares() = %v, want %v", got, tt.expected)
+            }
+        })
+    }
+}
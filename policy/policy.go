@@ -35,6 +35,8 @@ type Banning struct {
     InvalidPercent     float32    `json:"invalidPercent"`
     CheckThreshold     int32      `json:"checkThreshold"`
     MalformedLimit     int32      `json:"malformedLimit"`
+    // Submissions outside of session's nonce range, 0 disables banning for it
+    NonceRangeLimit    int32      `json:"nonceRangeLimit"`
 }
 
 type Stats struct {
@@ -46,6 +48,7 @@ type Stats struct {
     ValidShares        int32
     InvalidShares      int32
     Malformed          int32
+    OutOfRange         int32
     ConnLimit          int32
     Banned             int32
 }
@@ -220,6 +223,16 @@ func (s *PolicyServer) ApplyMalformedPolicy(ip string) bool {
     return true
 }
 
+func (s *PolicyServer) ApplyNonceRangePolicy(ip string) bool {
+    x := s.Get(ip)
+    n := x.incrOutOfRange()
+    if s.config.Banning.NonceRangeLimit > 0 && n >= s.config.Banning.NonceRangeLimit {
+        s.forceBan(x, ip)
+        return false
+    }
+    return true
+}
+
 func (s *PolicyServer) ApplySharePolicy(ip string, validShare bool) bool {
     x := s.Get(ip)
     x.Lock()
@@ -280,6 +293,10 @@ func (x *Stats) incrMalformed() int32 {
     return atomic.AddInt32(&x.Malformed, 1)
 }
 
+func (x *Stats) incrOutOfRange() int32 {
+    return atomic.AddInt32(&x.OutOfRange, 1)
+}
+
 func (x *Stats) decrLimit() int32 {
     return atomic.AddInt32(&x.ConnLimit, -1)
 }
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+    "encoding/json"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync/atomic"
+
+    "github.com/gorilla/mux"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/util"
+)
+
+type SessionInfo struct {
+    Ip             string    `json:"ip"`
+    Login          string    `json:"login"`
+    Worker         string    `json:"worker"`
+    Difficulty     int64     `json:"difficulty"`
+    ConnectedAt    int64     `json:"connectedAt"`
+    LastShareAt    int64     `json:"lastShareAt"`
+    Accepted       int64     `json:"accepted"`
+    Rejected       int64     `json:"rejected"`
+    Solo           bool      `json:"solo"`
+}
+
+func (s *ProxyServer) startAdmin() {
+    if len(s.config.Proxy.Admin.Token) == 0 {
+        log.Fatal("You must set admin API token")
+    }
+    token := s.config.Proxy.Admin.Token
+    r := mux.NewRouter()
+    r.HandleFunc("/sessions", util.BearerAuth(token, s.SessionsIndex)).Methods("GET")
+    r.HandleFunc("/sessions/disconnect", util.BearerAuth(token, s.DisconnectSessions)).Methods("POST")
+    s.adminServer = &http.Server{Addr: s.config.Proxy.Admin.Listen, Handler: r}
+
+    go func() {
+        log.Printf("Starting proxy admin API on %v", s.config.Proxy.Admin.Listen)
+        err := s.adminServer.ListenAndServe()
+        if err != nil && err != http.ErrServerClosed {
+            log.Fatalf("Failed to start proxy admin API: %v", err)
+        }
+    }()
+}
+
+func (cs *Session) info() SessionInfo {
+    login, worker, solo := cs.identity()
+    return SessionInfo{
+        Ip:          cs.ip,
+        Login:       login,
+        Worker:      worker,
+        Difficulty:  cs.currentDifficulty(),
+        ConnectedAt: cs.connectedAt,
+        LastShareAt: atomic.LoadInt64(&cs.lastShareAt),
+        Accepted:    atomic.LoadInt64(&cs.accepted),
+        Rejected:    atomic.LoadInt64(&cs.rejected),
+        Solo:        solo,
+    }
+}
+
+func (s *ProxyServer) SessionsIndex(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.WriteHeader(http.StatusOK)
+
+    stratums := make([]map[string]interface{}, len(s.stratum))
+    for i, stratum := range s.stratum {
+        stratumConfig := s.config.Proxy.Stratum[i]
+        stratum.sessionsMu.RLock()
+        sessions := make([]SessionInfo, 0, len(stratum.sessions))
+        for cs := range stratum.sessions {
+            sessions = append(sessions, cs.info())
+        }
+        stratum.sessionsMu.RUnlock()
+        stratums[i] = map[string]interface{}{
+            "name": stratumConfig.Name,
+            "listen": stratumConfig.Listen,
+            "sessions": sessions,
+            "sessionsTotal": len(sessions),
+        }
+    }
+
+    reply := map[string]interface{}{"stratums": stratums}
+    err := json.NewEncoder(w).Encode(reply)
+    if err != nil {
+        log.Println("Error serializing admin API response: ", err)
+    }
+}
+
+// Disconnects sessions matching all given login, worker and ip query params.
+// With ban=true every disconnected IP is banned by policy server as well.
+func (s *ProxyServer) DisconnectSessions(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+    w.Header().Set("Cache-Control", "no-cache")
+
+    query := r.URL.Query()
+    login := query.Get("login")
+    worker := query.Get("worker")
+    ip := query.Get("ip")
+    ban, _ := strconv.ParseBool(query.Get("ban"))
+
+    if len(login) == 0 && len(worker) == 0 && len(ip) == 0 {
+        w.WriteHeader(http.StatusBadRequest)
+        return
+    }
+
+    var matched []*Session
+    for _, stratum := range s.stratum {
+        stratum.sessionsMu.RLock()
+        for cs := range stratum.sessions {
+            csLogin, csWorker, _ := cs.identity()
+            if len(login) > 0 && !strings.EqualFold(csLogin, login) {
+                continue
+            }
+            if len(worker) > 0 && csWorker != worker {
+                continue
+            }
+            if len(ip) > 0 && cs.ip != ip {
+                continue
+            }
+            matched = append(matched, cs)
+        }
+        stratum.sessionsMu.RUnlock()
+    }
+
+    for _, cs := range matched {
+        stratumConfig := s.config.Proxy.Stratum[cs.s_id]
+        csLogin, csWorker, _ := cs.identity()
+        log.Printf("Disconnecting %v.%v@%v from %s by admin request", csLogin, csWorker, cs.ip, stratumConfig.Name)
+        if ban {
+            s.policy.BanClient(cs.ip)
+        }
+        s.removeSession(cs)
+        cs.conn.Close()
+    }
+
+    w.WriteHeader(http.StatusOK)
+    reply := map[string]interface{}{"disconnected": len(matched), "banned": ban}
+    err := json.NewEncoder(w).Encode(reply)
+    if err != nil {
+        log.Println("Error serializing admin API response: ", err)
+    }
+}
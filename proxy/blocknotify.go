@@ -0,0 +1,50 @@
+package proxy
+
+import (
+    "log"
+    "net"
+    "net/http"
+    "os"
+    "strings"
+
+    "github.com/gorilla/mux"
+)
+
+// Listens for new block notifications on TCP address or "unix:/path/to.sock"
+func (s *ProxyServer) startBlockNotify() {
+    cfg := s.config.Proxy.BlockNotify
+    var listener net.Listener
+    var err error
+    if strings.HasPrefix(cfg.Listen, "unix:") {
+        path := strings.TrimPrefix(cfg.Listen, "unix:")
+        // Socket is left behind by previous run
+        os.Remove(path)
+        listener, err = net.Listen("unix", path)
+    } else {
+        listener, err = net.Listen("tcp", cfg.Listen)
+    }
+    if err != nil {
+        log.Fatalf("Failed to start block notify listener: %v", err)
+    }
+
+    r := mux.NewRouter()
+    r.HandleFunc("/notify", s.BlockNotify).Methods("GET", "POST")
+    s.notifyServer = &http.Server{Handler: r}
+
+    go func() {
+        log.Printf("Listening for block notifications on %v", cfg.Listen)
+        err := s.notifyServer.Serve(listener)
+        if err != nil && err != http.ErrServerClosed {
+            log.Fatalf("Failed to serve block notifications: %v", err)
+        }
+    }()
+}
+
+// Triggers block template refresh, notifications arriving meanwhile are coalesced into one
+func (s *ProxyServer) BlockNotify(w http.ResponseWriter, r *http.Request) {
+    select {
+    case s.blockNotify <- struct{}{}:
+    default:
+    }
+    w.WriteHeader(http.StatusOK)
+}
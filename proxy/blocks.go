@@ -3,7 +3,9 @@ package proxy
 import (
     "log"
     "math/big"
+    "strings"
     "sync"
+    "time"
 
     "github.com/ethereum/go-ethereum/common"
     "github.com/NotoriousPyro/open-metaverse-pool/rpc"
@@ -17,13 +19,17 @@ type BlockTemplate struct {
     Difficulty                *big.Int
     Height                    uint64
     GetPendingBlockCache      *rpc.GetBlockReply
+    // Nonces submitted for this template, dropped along with the template
     nonces                    map[string]bool
+    // When newer template has arrived, guarded by ProxyServer.templatesMu
+    replacedAt                time.Time
 }
 
 type Block struct {
     difficulty                *big.Int
     hashNoNonce               common.Hash
     nonce                     uint64
+    // Zero if miner didn't send it, share verifier computes it then
     mixDigest                 common.Hash
     number                    uint64
 }
@@ -61,10 +67,16 @@ func (s *ProxyServer) fetchBlockTemplate() {
         Height:                  height,
         Difficulty:              diff,
         GetPendingBlockCache:    pendingReply,
+        nonces:                  make(map[string]bool),
     }
     
     s.blockTemplate.Store(&newTemplate)
+    s.pushBlockTemplate(&newTemplate)
+    s.notifyNewWork()
     log.Printf("New block to mine on %s at height %d / %s", rpc.Name, height, reply[0])
+    if s.config.Proxy.PPS.Enabled && s.config.Proxy.PPS.Full {
+        go s.updateTxFees(height)
+    }
     
     for i, setting := range s.config.Proxy.Stratum {
         if setting.Enabled {
@@ -73,6 +85,61 @@ func (s *ProxyServer) fetchBlockTemplate() {
      }
 }
 
+// Registers submitted nonce and returns true if it was submitted before
+func (t *BlockTemplate) isDuplicate(nonce string) bool {
+    t.Lock()
+    defer t.Unlock()
+
+    nonce = strings.ToLower(nonce)
+    if t.nonces[nonce] {
+        return true
+    }
+    t.nonces[nonce] = true
+    return false
+}
+
+func (s *ProxyServer) pushBlockTemplate(t *BlockTemplate) {
+    s.templatesMu.Lock()
+    defer s.templatesMu.Unlock()
+
+    if len(s.templates) > 0 {
+        s.templates[0].replacedAt = time.Now()
+    }
+    s.templates = append([]*BlockTemplate{t}, s.templates...)
+    if len(s.templates) > s.maxTemplates {
+        s.templates = s.templates[:s.maxTemplates]
+    }
+}
+
+// Returns current or recent template matching given criteria,
+// replaced templates match only within stale share grace period.
+func (s *ProxyServer) findBlockTemplate(match func(t *BlockTemplate) bool) *BlockTemplate {
+    s.templatesMu.RLock()
+    defer s.templatesMu.RUnlock()
+
+    for i, t := range s.templates {
+        if i > 0 && time.Since(t.replacedAt) > s.staleShareGrace {
+            break
+        }
+        if match(t) {
+            return t
+        }
+    }
+    return nil
+}
+
+func (s *ProxyServer) blockTemplateByHeader(header string) *BlockTemplate {
+    return s.findBlockTemplate(func(t *BlockTemplate) bool {
+        return strings.EqualFold(t.Header, header)
+    })
+}
+
+func (s *ProxyServer) blockTemplateByJob(id string) *BlockTemplate {
+    return s.findBlockTemplate(func(t *BlockTemplate) bool {
+        return jobId(t.Header) == id
+    })
+}
+
 func (s *ProxyServer) fetchPendingBlock() (*rpc.GetBlockReply, uint64, *big.Int, error) {
     rpc := s.rpc()
     reply, err := rpc.GetPendingBlock()
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+    "encoding/json"
+    "errors"
+    "log"
+    "strings"
+    "sync/atomic"
+    "time"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/util"
+)
+
+// Job encoded once and shared by all sessions with the same difficulty
+type jobMessage struct {
+    data        []byte
+    queuedAt    time.Time
+}
+
+var errQueueFull = errors.New("Job queue is full")
+
+// Encodes job for a session difficulty, ready to be written to socket as is
+func (s *ProxyServer) encodeJob(s_id int, t *BlockTemplate, diff int64) ([]byte, error) {
+    if s.isEthereumStratum(s_id) {
+        // Difficulty is sent along with every job, so a retarget is never missed
+        setDiff := JSONStratumNotification{Method: "mining.set_difficulty", Params: []float64{float64(diff) / pow32}}
+        data, err := json.Marshal(&setDiff)
+        if err != nil {
+            return nil, err
+        }
+        params := []interface{}{jobId(t.Header), strings.TrimPrefix(t.Seed, "0x"), strings.TrimPrefix(t.Header, "0x"), true}
+        notify := JSONStratumNotification{Method: "mining.notify", Params: params}
+        job, err := json.Marshal(&notify)
+        if err != nil {
+            return nil, err
+        }
+        data = append(data, '\n')
+        data = append(data, job...)
+        return append(data, '\n'), nil
+    }
+    reply := []string{t.Header, t.Seed, util.GetTargetHex(diff)}
+    // FIXME: Temporarily add ID for Claymore compliance
+    message := JSONPushMessage{Version: "2.0", Result: &reply, Id: 0}
+    data, err := json.Marshal(&message)
+    if err != nil {
+        return nil, err
+    }
+    return append(data, '\n'), nil
+}
+
+// Never blocks, a session which can't keep up with jobs is a dead session
+func (cs *Session) queue(job *jobMessage) error {
+    select {
+    case cs.out <- job:
+        return nil
+    default:
+        return errQueueFull
+    }
+}
+
+func (s *ProxyServer) sendJob(cs *Session, t *BlockTemplate) error {
+    data, err := s.encodeJob(cs.s_id, t, cs.currentDifficulty())
+    if err != nil {
+        return err
+    }
+    return cs.queue(&jobMessage{data: data, queuedAt: time.Now()})
+}
+
+func (s *ProxyServer) sessionWriter(cs *Session) {
+    stratumConfig := s.config.Proxy.Stratum[cs.s_id]
+    for {
+        select {
+        case job := <-cs.out:
+            err := s.writeJob(cs, job)
+            if err != nil {
+                login, _, _ := cs.identity()
+                log.Printf("Job transmit error from %s to %v@%v: %v", stratumConfig.Name, login, cs.ip, err)
+                s.removeSession(cs)
+                cs.conn.Close()
+                return
+            }
+        case <-cs.done:
+            return
+        }
+    }
+}
+
+func (s *ProxyServer) writeJob(cs *Session, job *jobMessage) error {
+    cs.Lock()
+    defer cs.Unlock()
+
+    cs.conn.SetWriteDeadline(time.Now().Add(JobWriteTimeout))
+    _, err := cs.conn.Write(job.data)
+    if err != nil {
+        return err
+    }
+    s.setDeadline(cs.conn, cs.s_id)
+    s.stratum[cs.s_id].recordFanout(time.Since(job.queuedAt))
+    return nil
+}
+
+func (stratum *StratumServer) recordFanout(latency time.Duration) {
+    atomic.AddInt64(&stratum.fanoutCount, 1)
+    atomic.AddInt64(&stratum.fanoutSum, int64(latency))
+    for {
+        max := atomic.LoadInt64(&stratum.fanoutMax)
+        if int64(latency) <= max || atomic.CompareAndSwapInt64(&stratum.fanoutMax, max, int64(latency)) {
+            return
+        }
+    }
+}
+
+// Returns average and max fan-out latency since previous call
+func (stratum *StratumServer) resetFanout() (time.Duration, time.Duration) {
+    count := atomic.SwapInt64(&stratum.fanoutCount, 0)
+    sum := atomic.SwapInt64(&stratum.fanoutSum, 0)
+    max := atomic.SwapInt64(&stratum.fanoutMax, 0)
+    if count == 0 {
+        return 0, 0
+    }
+    return time.Duration(sum / count), time.Duration(max)
+}
+
+func (s *ProxyServer) broadcastNewJobs(s_id int) {
+    proxyConfig := s.config.Proxy
+    stratumConfig := proxyConfig.Stratum[s_id]
+    t := s.currentBlockTemplate()
+    if t == nil || len(t.Header) == 0 || s.isSick() || s.isStopping() {
+        return
+    }
+    stratum := s.stratum[s_id]
+
+    // Don't hold sessions lock while broadcasting, logins and disconnects must not wait
+    stratum.sessionsMu.RLock()
+    sessions := make([]*Session, 0, len(stratum.sessions))
+    for cs := range stratum.sessions {
+        sessions = append(sessions, cs)
+    }
+    stratum.sessionsMu.RUnlock()
+
+    count := len(sessions)
+    log.Printf("Broadcasting new job to %v miners on %s", count, stratumConfig.Name)
+    s.backend.WriteStratumState(proxyConfig.Name, stratumConfig.Name, stratumConfig.Listen, count, stratumConfig.Difficulty)
+
+    // Writers of previous job are done by now, except for sessions about to be dropped
+    fanoutAvg, fanoutMax := stratum.resetFanout()
+
+    start := time.Now()
+    jobs := make(map[int64]*jobMessage)
+    dropped := 0
+
+    for _, cs := range sessions {
+        s.retargetSession(cs, false)
+        diff := cs.currentDifficulty()
+        job, ok := jobs[diff]
+        if !ok {
+            data, err := s.encodeJob(s_id, t, diff)
+            if err != nil {
+                log.Printf("Failed to encode job on %s: %v", stratumConfig.Name, err)
+                return
+            }
+            job = &jobMessage{data: data, queuedAt: start}
+            jobs[diff] = job
+        }
+        err := cs.queue(job)
+        if err != nil {
+            login, _, _ := cs.identity()
+            log.Printf("Dropping slow session %v@%v on %s: %v", login, cs.ip, stratumConfig.Name, err)
+            s.removeSession(cs)
+            cs.conn.Close()
+            dropped++
+        }
+    }
+    elapsed := time.Since(start)
+    log.Printf("Jobs broadcast on %s finished in %s (%v encoded, %v dropped)", stratumConfig.Name, elapsed, len(jobs), dropped)
+    err := s.backend.WriteBroadcastState(proxyConfig.Name, stratumConfig.Name, elapsed, fanoutAvg, fanoutMax)
+    if err != nil {
+        log.Printf("Failed to write broadcast stats to backend: %v", err)
+    }
+}
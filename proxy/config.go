@@ -4,6 +4,7 @@ import (
     "github.com/NotoriousPyro/open-metaverse-pool/api"
     "github.com/NotoriousPyro/open-metaverse-pool/payouts"
     "github.com/NotoriousPyro/open-metaverse-pool/policy"
+    "github.com/NotoriousPyro/open-metaverse-pool/reward"
     "github.com/NotoriousPyro/open-metaverse-pool/storage"
 )
 
@@ -15,14 +16,19 @@ type Config struct {
     Api                       api.ApiConfig    `json:"api"`
     Upstream                  []Upstream       `json:"upstream"`
     UpstreamCheckInterval     string           `json:"upstreamCheckInterval"`
+    UpstreamPolicy            UpstreamPolicy   `json:"upstreamPolicy"`
 
     Threads                   int              `json:"threads"`
+    ShutdownTimeout           string           `json:"shutdownTimeout"`
 
     Coin                      string              `json:"coin"`
     Redis                     storage.Config      `json:"redis"`
     
     BlockUnlocker             payouts.UnlockerConfig       `json:"unlocker"`
     Payouts                   payouts.PayoutsConfig        `json:"payouts"`
+    ReorgWatcher              payouts.ReorgConfig          `json:"reorgWatcher"`
+    // Shared by unlocker and PPS proxies
+    RewardSchedule            reward.Schedule              `json:"rewardSchedule"`
 
     NewrelicName              string    `json:"newrelicName"`
     NewrelicKey               string    `json:"newrelicKey"`
@@ -39,8 +45,21 @@ type Proxy struct {
     LimitBodySize           int64       `json:"limitBodySize"`
     BehindReverseProxy      bool        `json:"behindReverseProxy"`
     BlockRefreshInterval    string      `json:"blockRefreshInterval"`
+    // How long HTTP getwork requests with X-Long-Poll header wait for a new job, disabled if empty
+    LongPollTimeout         string      `json:"longPollTimeout"`
+    BlockNotify             BlockNotify `json:"blockNotify"`
+    // Number of recent block templates to keep and how long shares for replaced ones are credited
+    MaxTemplates            int         `json:"maxTemplates"`
+    StaleShareGrace         string      `json:"staleShareGrace"`
     StateUpdateInterval     string      `json:"stateUpdateInterval"`
     HashrateExpiration      string      `json:"hashrateExpiration"`
+    ShareWriter             ShareWriter `json:"shareWriter"`
+    // Several proxies write to the same Redis, duplicate shares are checked across them
+    SharedBackend           bool        `json:"sharedBackend"`
+    // Keep ordered log of pooled shares, must be enabled exactly when unlocker pays PPLNS
+    ShareLog                bool        `json:"shareLog"`
+    PPS                     PPS         `json:"pps"`
+    Verifier                Verifier    `json:"verifier"`
 
     Policy                  policy.Config   `json:"policy"`
 
@@ -48,15 +67,90 @@ type Proxy struct {
     HealthCheck             bool            `json:"healthCheck"`
 
     Stratum                 []Stratum       `json:"stratum"`
+
+    Admin                   Admin           `json:"admin"`
 }
 
-type Stratum struct {
-    Name           string      `json:"name"`
+// Pays expected value of every pooled share at once, unlocker must run in PPS mode as well.
+// Block rewards are taken from rewardSchedule.
+type PPS struct {
+    Enabled            bool        `json:"enabled"`
+    // FPPS, average transaction fees of last feeBlocks blocks are paid as well
+    Full               bool        `json:"full"`
+    FeeBlocks          int         `json:"feeBlocks"`
+    Fee                float64     `json:"fee"`
+}
+
+type BlockNotify struct {
+    Enabled            bool        `json:"enabled"`
+    Listen             string      `json:"listen"`
+    FallbackInterval   string      `json:"fallbackInterval"`
+}
+
+// Number of share verification workers defaults to number of CPUs
+type Verifier struct {
+    Workers        int         `json:"workers"`
+    QueueSize      int         `json:"queueSize"`
+}
+
+type ShareWriter struct {
+    BufferSize     int         `json:"bufferSize"`
+    BatchSize      int         `json:"batchSize"`
+    FlushInterval  string      `json:"flushInterval"`
+}
+
+type Admin struct {
     Enabled        bool        `json:"enabled"`
     Listen         string      `json:"listen"`
-    Timeout        string      `json:"timeout"`
-    MaxConn        int         `json:"maxConn"`
-    Difficulty     int64       `json:"difficulty"`
+    Token          string      `json:"token"`
+}
+
+type Stratum struct {
+    Name           string          `json:"name"`
+    Enabled        bool            `json:"enabled"`
+    Listen         string          `json:"listen"`
+    Timeout        string          `json:"timeout"`
+    MaxConn        int             `json:"maxConn"`
+    Protocol       string          `json:"protocol"`
+    ExtraNonce     bool            `json:"extraNonce"`
+    Solo           bool            `json:"solo"`
+    Difficulty     int64           `json:"difficulty"`
+    VarDiff        VarDiff         `json:"varDiff"`
+    TLS            StratumTLS      `json:"tls"`
+    ProxyProtocol  ProxyProtocol   `json:"proxyProtocol"`
+}
+
+type ProxyProtocol struct {
+    Enabled        bool        `json:"enabled"`
+    Trusted        []string    `json:"trusted"`
+}
+
+type StratumTLS struct {
+    Enabled        bool        `json:"enabled"`
+    CertFile       string      `json:"certFile"`
+    KeyFile        string      `json:"keyFile"`
+    MinVersion     string      `json:"minVersion"`
+    ClientCA       string      `json:"clientCA"`
+}
+
+type VarDiff struct {
+    Enabled            bool        `json:"enabled"`
+    MinDiff            int64       `json:"minDiff"`
+    MaxDiff            int64       `json:"maxDiff"`
+    TargetTime         string      `json:"targetTime"`
+    RetargetTime       string      `json:"retargetTime"`
+    VariancePercent    float64     `json:"variancePercent"`
+}
+
+type UpstreamPolicy struct {
+    // One of "priority", "height" or "latency", upstreams order is used to break ties
+    Strategy       string      `json:"strategy"`
+    MaxHeightLag   uint64      `json:"maxHeightLag"`
+    MinPeers       int         `json:"minPeers"`
+    MaxErrorRate   float64     `json:"maxErrorRate"`
+    // Better upstream must win that many checks in a row before switching to it
+    SwitchChecks   int         `json:"switchChecks"`
+    LatencyMargin  float64     `json:"latencyMargin"`
 }
 
 type Upstream struct {
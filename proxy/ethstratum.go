@@ -0,0 +1,153 @@
+package proxy
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "math"
+    "math/rand"
+    "regexp"
+    "strings"
+    "sync/atomic"
+)
+
+const (
+    EthProxy = "eth-proxy"
+    EthereumStratum = "EthereumStratum/1.0.0"
+)
+
+var (
+    // EthereumStratum difficulty 1 equals to 2^32 hashes
+    pow32 = math.Pow(2, 32)
+    hexPattern = regexp.MustCompile("^[0-9a-f]+$")
+)
+
+func (s *ProxyServer) isEthereumStratum(s_id int) bool {
+    return s.config.Proxy.Stratum[s_id].Protocol == EthereumStratum
+}
+
+// Extranonce is unique among all ports, as they all serve the same header
+func (s *ProxyServer) allocExtraNonce() string {
+    n := atomic.AddUint32(&s.extraNonce, 1)
+    return fmt.Sprintf("%06x", n&0xffffff)
+}
+
+// Job ID is derived from header, so it's the same for all sessions and proxies
+func jobId(header string) string {
+    h := strings.TrimPrefix(header, "0x")
+    if len(h) > 16 {
+        return h[:16]
+    }
+    return h
+}
+
+func (cs *Session) handleEthStratumMessage(s *ProxyServer, req *StratumReq) error {
+    stratumConfig := s.config.Proxy.Stratum[cs.s_id]
+    // Handle RPC methods
+    switch req.Method {
+        case "mining.subscribe":
+            var params []string
+            err := json.Unmarshal(req.Params, &params)
+            if err != nil {
+                log.Printf("Malformed stratum request params on %s from %s", stratumConfig.Name, cs.ip)
+                return err
+            }
+            if len(params) > 1 && params[1] != EthereumStratum {
+                errReply := &ErrorReply{Code: -1, Message: "Unsupported protocol"}
+                return cs.sendTCPError(req.Id, errReply)
+            }
+            cs.extraNonce = s.allocExtraNonce()
+            sessionId := fmt.Sprintf("%016x", rand.Int63())
+            reply := []interface{}{[]string{"mining.notify", sessionId, EthereumStratum}, cs.extraNonce}
+            return cs.sendTCPResult(req.Id, reply)
+        case "mining.extranonce.subscribe":
+            return cs.sendTCPResult(req.Id, true)
+        case "mining.authorize":
+            if len(cs.extraNonce) == 0 {
+                errReply := &ErrorReply{Code: 25, Message: "Not subscribed"}
+                return cs.sendTCPError(req.Id, errReply)
+            }
+            var params []string
+            err := json.Unmarshal(req.Params, &params)
+            if err != nil {
+                log.Printf("Malformed stratum request params on %s from %s", stratumConfig.Name, cs.ip)
+                return err
+            }
+            reply, errReply := s.handleLoginRPC(cs, params, req.Worker)
+            if errReply != nil {
+                return cs.sendTCPError(req.Id, errReply)
+            }
+            err = cs.sendTCPResult(req.Id, reply)
+            if err != nil {
+                return err
+            }
+            return s.pushSessionJob(cs)
+        case "mining.submit":
+            var params []string
+            err := json.Unmarshal(req.Params, &params)
+            if err != nil {
+                log.Printf("Malformed stratum request params on %s from %s", stratumConfig.Name, cs.ip)
+                return err
+            }
+            reply, errReply := s.handleEthStratumSubmitRPC(cs, params)
+            cs.recordShare(reply)
+            if errReply != nil {
+                return cs.sendTCPError(req.Id, errReply)
+            }
+            err = cs.sendTCPResult(req.Id, reply)
+            if err != nil {
+                return err
+            }
+            if reply && s.retargetSession(cs, true) {
+                return s.pushSessionJob(cs)
+            }
+            return nil
+        case "eth_submitHashrate":
+            var params []string
+            err := json.Unmarshal(req.Params, &params)
+            if err != nil {
+                log.Printf("Malformed stratum request params on %s from %s", stratumConfig.Name, cs.ip)
+                return err
+            }
+            reply := s.handleSubmitHashrateRPC(cs, cs.login, cs.workerId(req.Worker), params)
+            return cs.sendTCPResult(req.Id, reply)
+        default:
+            errReply := s.handleUnknownRPC(cs, req.Method)
+            return cs.sendTCPError(req.Id, errReply)
+    }
+}
+
+// Params are: worker, job ID and nonce without extranonce prefix.
+// Miner doesn't send mix digest, share verifier computes it along with share hash.
+func (s *ProxyServer) handleEthStratumSubmitRPC(cs *Session, params []string) (bool, *ErrorReply) {
+    stratumConfig := s.config.Proxy.Stratum[cs.s_id]
+    if len(params) != 3 {
+        s.policy.ApplyMalformedPolicy(cs.ip)
+        log.Printf("Malformed params on %s from %s : %s %v", stratumConfig.Name, cs.ip, cs.login, params)
+        return false, &ErrorReply{Code: -1, Message: "Invalid params"}
+    }
+
+    minerNonce := strings.ToLower(strings.TrimPrefix(params[2], "0x"))
+    nonceHex := cs.extraNonce + minerNonce
+    if len(nonceHex) != 16 || !hexPattern.MatchString(minerNonce) {
+        s.policy.ApplyMalformedPolicy(cs.ip)
+        log.Printf("Malformed nonce on %s from %s : %s %v", stratumConfig.Name, cs.ip, cs.login, params)
+        return false, &ErrorReply{Code: -1, Message: "Malformed PoW result"}
+    }
+
+    if s.isSick() {
+        return false, &ErrorReply{Code: 0, Message: "Work not ready"}
+    }
+    t := s.blockTemplateByJob(params[1])
+    if t == nil {
+        log.Printf("Stale share on %s from %s : %s %v", stratumConfig.Name, cs.ip, cs.login, params)
+        s.policy.ApplySharePolicy(cs.ip, false)
+        return false, nil
+    }
+
+    if !s.isRegistered(cs) {
+        return false, &ErrorReply{Code: 25, Message: "Not subscribed"}
+    }
+    submit := []string{"0x" + nonceHex, strings.ToLower(t.Header), ""}
+    return s.submitShare(cs, cs.login, cs.workerId(params[0]), t, submit)
+}
@@ -3,6 +3,8 @@ package proxy
 import (
     "log"
     "regexp"
+    "strconv"
+    "strings"
     
     "github.com/NotoriousPyro/open-metaverse-pool/rpc"
     "github.com/NotoriousPyro/open-metaverse-pool/util"
@@ -14,58 +16,113 @@ var (
     workerPattern = regexp.MustCompile("^[0-9a-zA-Z-_]{1,8}$")
 )
 
+// Miners logged in with this prefix mine solo on any port
+const SoloPrefix = "solo:"
+
+// Login is either "address" or "address.worker", otherwise worker may be sent in request,
+// "solo:" prefix selects solo mining
 func (s *ProxyServer) handleLoginRPC(cs *Session, params []string, id string) (bool, *ErrorReply) {
     if len(params) == 0 {
         return false, &ErrorReply{Code: -1, Message: "Invalid params"}
     }
     
-    login := params[0]
+    stratumConfig := s.config.Proxy.Stratum[cs.s_id]
+    loginParam := params[0]
+    solo := stratumConfig.Solo
+    if strings.HasPrefix(loginParam, SoloPrefix) {
+        solo = true
+        loginParam = strings.TrimPrefix(loginParam, SoloPrefix)
+    }
+    
+    login, worker := splitLogin(loginParam)
+    if len(worker) == 0 {
+        worker = id
+    } else if !workerPattern.MatchString(worker) {
+        s.policy.ApplyMalformedPolicy(cs.ip)
+        return false, &ErrorReply{Code: -1, Message: "Invalid worker name."}
+    }
     
     if !util.IsValidHexAddress(login) {
-        return false, &ErrorReply{Code: -1, Message: "Invalid login format."}
         s.policy.ApplyMalformedPolicy(cs.ip)
+        return false, &ErrorReply{Code: -1, Message: "Invalid login format."}
     }
     
     address, err := s.rpc().ValidateAddress(login)
     
-    if !address.Valid() || err != nil || address == nil {
-        return false, &ErrorReply{Code: 0, Message: "Invalid login."}
+    if err != nil || address == nil || !address.Valid() {
         s.policy.ApplyMalformedPolicy(cs.ip)
+        return false, &ErrorReply{Code: 0, Message: "Invalid login."}
     }
     
     if !s.policy.ApplyLoginPolicy(login, cs.ip) {
         return false, &ErrorReply{Code: -1, Message: "You are blacklisted"}
     }
     
+    cs.loginMu.Lock()
     cs.login = login
+    if workerPattern.MatchString(worker) {
+        cs.worker = worker
+    }
+    cs.solo = solo
+    cs.loginMu.Unlock()
     s.registerSession(cs)
     
-    stratumConfig := s.config.Proxy.Stratum[cs.s_id]
-    
-    log.Printf("Stratum miner connected on %s from %s : %s", stratumConfig.Name, cs.ip, login)
+    if solo {
+        log.Printf("Stratum solo miner connected on %s from %s : %s.%s", stratumConfig.Name, cs.ip, login, cs.workerId(""))
+    } else {
+        log.Printf("Stratum miner connected on %s from %s : %s.%s", stratumConfig.Name, cs.ip, login, cs.workerId(""))
+    }
     
     return true, nil
 }
 
+func splitLogin(s string) (string, string) {
+    parts := strings.SplitN(s, ".", 2)
+    if len(parts) == 2 {
+        return parts[0], parts[1]
+    }
+    return parts[0], ""
+}
+
+// Worker from login takes precedence over the one sent with request
+func (cs *Session) workerId(id string) string {
+    if len(cs.worker) > 0 {
+        return cs.worker
+    }
+    if !workerPattern.MatchString(id) {
+        return "0"
+    }
+    return id
+}
+
+// Login, worker and solo mode, safe to call outside of connection goroutine
+func (cs *Session) identity() (string, string, bool) {
+    cs.loginMu.RLock()
+    defer cs.loginMu.RUnlock()
+    return cs.login, cs.workerId(""), cs.solo
+}
+
 func (s *ProxyServer) handleGetWorkRPC(cs *Session) ([]string, *ErrorReply) {
     t := s.currentBlockTemplate()
     if t == nil || len(t.Header) == 0 || s.isSick() {
         return nil, &ErrorReply{Code: 0, Message: "Work not ready"}
     }
-    diff := s.stratum[cs.s_id].diff
-    return []string{t.Header, t.Seed, diff}, nil
+    return []string{t.Header, t.Seed, cs.currentTarget()}, nil
 }
 
 func (s *ProxyServer) handleTCPSubmitRPC(cs *Session, id string, params []string) (bool, *ErrorReply) {
+    if !s.isRegistered(cs) {
+        return false, &ErrorReply{Code: 25, Message: "Not subscribed"}
+    }
+    return s.handleSubmitRPC(cs, cs.login, cs.workerId(id), params)
+}
+
+func (s *ProxyServer) isRegistered(cs *Session) bool {
     stratum := s.stratum[cs.s_id]
     stratum.sessionsMu.RLock()
+    defer stratum.sessionsMu.RUnlock()
     _, ok := stratum.sessions[cs]
-    stratum.sessionsMu.RUnlock()
-
-    if !ok {
-        return false, &ErrorReply{Code: 25, Message: "Not subscribed"}
-    }
-    return s.handleSubmitRPC(cs, cs.login, id, params)
+    return ok
 }
 
 func (s *ProxyServer) handleSubmitRPC(cs *Session, login, id string, params []string) (bool, *ErrorReply) {
@@ -84,8 +141,29 @@ func (s *ProxyServer) handleSubmitRPC(cs *Session, login, id string, params []st
         log.Printf("Malformed PoW result on %s from %s : %s %v", stratumConfig.Name, cs.ip, login, params)
         return false, &ErrorReply{Code: -1, Message: "Malformed PoW result"}
     }
-    t := s.currentBlockTemplate()
-    exist, valid, stale := s.processShare(login, id, cs.ip, t, params, cs.s_id)
+    if !strings.HasPrefix(params[0], "0x" + cs.extraNonce) {
+        s.policy.ApplyNonceRangePolicy(cs.ip)
+        log.Printf("Nonce out of range %s on %s from %s : %s %v", cs.extraNonce, stratumConfig.Name, cs.ip, login, params)
+        return false, &ErrorReply{Code: 20, Message: "Nonce out of range"}
+    }
+    t := s.blockTemplateByHeader(params[1])
+    if t == nil {
+        log.Printf("Stale share on %s from %s : %s %v", stratumConfig.Name, cs.ip, login, params)
+        s.policy.ApplySharePolicy(cs.ip, false)
+        return false, nil
+    }
+    return s.submitShare(cs, login, id, t, params)
+}
+
+// Verifies share of given template and applies share policy, empty mix digest is computed by share verifier
+func (s *ProxyServer) submitShare(cs *Session, login, id string, t *BlockTemplate, params []string) (bool, *ErrorReply) {
+    stratumConfig := s.config.Proxy.Stratum[cs.s_id]
+    exist, valid, stale, err := s.processShare(login, id, cs.ip, s.shareDifficulty(cs), t, params, cs.solo)
+    if err != nil {
+        log.Printf("Share not verified on %s from %s : %s %v: %v", stratumConfig.Name, cs.ip, login, params, err)
+        // Reconnecting miners would add login load to overloaded pool
+        return false, &ErrorReply{Code: -1, Message: "Server busy", keepAlive: true}
+    }
     ok := s.policy.ApplySharePolicy(cs.ip, !exist && valid)
     
     if exist && valid {
@@ -113,6 +191,25 @@ func (s *ProxyServer) handleSubmitRPC(cs *Session, login, id string, params []st
     return true, nil
 }
 
+// Params are hashrate and client ID as hex strings
+func (s *ProxyServer) handleSubmitHashrateRPC(cs *Session, login, id string, params []string) bool {
+    if len(login) == 0 || len(params) != 2 || !hashPattern.MatchString(params[1]) {
+        return false
+    }
+    if !workerPattern.MatchString(id) {
+        id = "0"
+    }
+    hashrate, err := strconv.ParseUint(strings.TrimPrefix(params[0], "0x"), 16, 63)
+    if err != nil {
+        return false
+    }
+    err = s.backend.WriteReportedHashrate(login, id, int64(hashrate), params[1], s.hashrateExpiration)
+    if err != nil {
+        log.Printf("Failed to write reported hashrate of %v@%v to backend: %v", login, cs.ip, err)
+    }
+    return true
+}
+
 func (s *ProxyServer) handleGetBlockByNumberRPC() *rpc.GetBlockReply {
     t := s.currentBlockTemplate()
     var reply *rpc.GetBlockReply
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+    "net/http"
+    "strings"
+    "time"
+)
+
+// Request header carrying header hash of the job miner already has,
+// any other value just waits for the next job
+const longPollHeader = "X-Long-Poll"
+
+// Returns channel which is closed once a new block template is stored
+func (s *ProxyServer) newWork() <-chan struct{} {
+    s.workMu.Lock()
+    defer s.workMu.Unlock()
+    return s.workCh
+}
+
+// Wakes up all long polling requests
+func (s *ProxyServer) notifyNewWork() {
+    s.workMu.Lock()
+    defer s.workMu.Unlock()
+    close(s.workCh)
+    s.workCh = make(chan struct{})
+}
+
+func (s *ProxyServer) isLongPoll(r *http.Request) bool {
+    return s.longPollTimeout > 0 && len(r.Header.Get(longPollHeader)) > 0
+}
+
+// Holds request until template differs from the one miner has or timeout passes
+func (s *ProxyServer) waitNewWork(r *http.Request) {
+    workCh := s.newWork()
+    if s.isStopping() {
+        return
+    }
+    known := r.Header.Get(longPollHeader)
+    t := s.currentBlockTemplate()
+    if t != nil && hashPattern.MatchString(known) && !strings.EqualFold(t.Header, known) {
+        return
+    }
+
+    timer := time.NewTimer(s.longPollTimeout)
+    defer timer.Stop()
+    select {
+    case <-workCh:
+    case <-timer.C:
+    case <-r.Context().Done():
+    }
+}
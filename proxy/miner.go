@@ -8,22 +8,23 @@ import (
 
     "github.com/ethereum/ethash"
     "github.com/ethereum/go-ethereum/common"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/storage"
+    "github.com/NotoriousPyro/open-metaverse-pool/util"
 )
 
 var hasher = ethash.New()
 
-// returns exist, valid, stale as boolean
-func (s *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, params []string, s_id int) (bool, bool, bool) {
-    stratumConfig := s.config.Proxy.Stratum[s_id]
+// returns exist, valid, stale as boolean, error if share couldn't be verified
+func (s *ProxyServer) processShare(login, id, ip string, shareDiff int64, t *BlockTemplate, params []string, solo bool) (bool, bool, bool, error) {
     nonceHex := params[0]
     hashNoNonce := params[1]
     mixDigest := params[2]
     nonce, _ := strconv.ParseUint(strings.Replace(nonceHex, "0x", "", -1), 16, 64)
-    shareDiff := stratumConfig.Difficulty
     
     if !strings.EqualFold(t.Header, hashNoNonce) {
         // Stale Share
-        return false, false, true
+        return false, false, true, nil
     }
     
     share := Block{
@@ -34,33 +35,52 @@ func (s *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, param
         mixDigest:   common.HexToHash(mixDigest),
     }
     
-    block := Block{
-        number:      t.Height,
-        hashNoNonce: common.HexToHash(hashNoNonce),
-        difficulty:  t.Difficulty,
-        nonce:       nonce,
-        mixDigest:   common.HexToHash(mixDigest),
+    result, err := s.verifier.verify(share, t.Difficulty)
+    if err != nil {
+        return false, false, false, err
     }
-    
-    if !hasher.Verify(share) {
+    if !result.valid {
         // Invalid Share
-        return false, false, false
+        return false, false, false, nil
+    }
+    if share.mixDigest == (common.Hash{}) {
+        params = []string{nonceHex, hashNoNonce, strings.ToLower(result.mixDigest.Hex())}
+    }
+
+    if t.isDuplicate(nonceHex) {
+        // Duplicate Share
+        return true, true, false, nil
     }
     
-    if hasher.Verify(block) {
-        ok, err := s.rpc().SubmitWork(params)
+    entry := &storage.Share{
+        Login:     login,
+        Id:        id,
+        Params:    params,
+        Diff:      shareDiff,
+        Height:    t.Height,
+        Timestamp: util.MakeTimestamp(),
+        Solo:      solo,
+    }
+    if !solo && s.config.Proxy.PPS.Enabled {
+        entry.Reward = s.shareValue(shareDiff, t)
+    }
+    
+    if result.block {
+        ok, err := s.submitBlock(t.Height, params)
         if err != nil {
             log.Printf("Block submission failure at height %v for %v: %v", t.Height, t.Header, err)
         } else if !ok {
             log.Printf("Block rejected at height %v for %v", t.Height, t.Header)
             // Rejected Block
-            return false, false, false
+            return false, false, false, nil
         } else {
             s.fetchBlockTemplate()
-            exist, err := s.backend.WriteBlock(login, id, params, shareDiff, t.Difficulty.Int64(), t.Height, s.hashrateExpiration)
+            // Queued shares belong to the round closed by this block
+            s.shareWriter.sync()
+            exist, err := s.backend.WriteBlock(entry, t.Difficulty.Int64(), s.hashrateExpiration, s.config.Proxy.ShareLog)
             if exist {
                 // Duplicate Block
-                return true, true, false
+                return true, true, false, nil
             }
             if err != nil {
                 log.Println("Failed to insert block candidate into backend:", err)
@@ -68,18 +88,15 @@ func (s *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, param
                 // Valid Block
                 log.Printf("Inserted block %v to backend", t.Height)
             }
-            log.Printf("Block found by miner %v@%v at height %d", login, ip, t.Height)
+            if solo {
+                log.Printf("Solo block found by miner %v@%v at height %d", login, ip, t.Height)
+            } else {
+                log.Printf("Block found by miner %v@%v at height %d", login, ip, t.Height)
+            }
         }
     } else {
-        exist, err := s.backend.WriteShare(login, id, params, shareDiff, t.Height, s.hashrateExpiration)
-        if exist {
-            // Duplicate Share
-            return true, true, false
-        }
-        if err != nil {
-            log.Println("Failed to insert share data into backend:", err)
-        }
+        s.shareWriter.enqueue(entry)
     }
     // Valid Share
-    return false, true, false
+    return false, true, false, nil
 }
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+    "log"
+    "math/big"
+    "strconv"
+    "sync"
+    "sync/atomic"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/reward"
+)
+
+const defaultFeeBlocks = 100
+
+// Transaction fees of recent network blocks, averaged for FPPS
+type txFees struct {
+    // Accessed atomically, so keep it first in order to avoid alignment issue
+    updating    int32
+
+    sync.RWMutex
+    fees        []int64
+    next        int
+    sum         int64
+    // Last block counted
+    height      uint64
+}
+
+func newTxFees(cfg *PPS) *txFees {
+    size := defaultFeeBlocks
+    if cfg.FeeBlocks > 0 {
+        size = cfg.FeeBlocks
+    }
+    return &txFees{fees: make([]int64, 0, size)}
+}
+
+func (f *txFees) add(height uint64, fee int64) {
+    f.Lock()
+    defer f.Unlock()
+
+    if len(f.fees) < cap(f.fees) {
+        f.fees = append(f.fees, fee)
+    } else {
+        f.sum -= f.fees[f.next]
+        f.fees[f.next] = fee
+        f.next = (f.next + 1) % len(f.fees)
+    }
+    f.sum += fee
+    f.height = height
+}
+
+func (f *txFees) average() int64 {
+    f.RLock()
+    defer f.RUnlock()
+
+    if len(f.fees) == 0 {
+        return 0
+    }
+    return f.sum / int64(len(f.fees))
+}
+
+func (f *txFees) lastHeight() uint64 {
+    f.RLock()
+    defer f.RUnlock()
+    return f.height
+}
+
+// Counts fees of blocks mined since last update, only one update runs at a time
+func (s *ProxyServer) updateTxFees(height uint64) {
+    f := s.txFees
+    if !atomic.CompareAndSwapInt32(&f.updating, 0, 1) {
+        return
+    }
+    defer atomic.StoreInt32(&f.updating, 0)
+
+    if height == 0 {
+        return
+    }
+    // Pending block is not mined yet
+    last := height - 1
+    from := f.lastHeight() + 1
+    // Only the last window of blocks is counted after startup or a long pause
+    if from+uint64(cap(f.fees)) <= last {
+        from = last + 1 - uint64(cap(f.fees))
+    }
+    for h := from; h <= last; h++ {
+        reply, err := s.rpc().GetBlockTxs(h)
+        if err != nil {
+            log.Printf("Failed to get transaction fees of block %v: %v", h, err)
+            return
+        }
+        coinbase, err := reward.CoinbaseValue(reply)
+        if err != nil {
+            log.Printf("Failed to get transaction fees of block %v: %v", h, err)
+            return
+        }
+        blockReward, _ := s.config.RewardSchedule.BlockReward(h)
+        fee := new(big.Int).Sub(coinbase, blockReward).Int64()
+        if fee < 0 {
+            fee = 0
+        }
+        f.add(h, fee)
+    }
+}
+
+// Expected reward for share with fee deducted, average transaction fees are added for FPPS
+func (s *ProxyServer) shareValue(shareDiff int64, t *BlockTemplate) int64 {
+    cfg := &s.config.Proxy.PPS
+    blockReward, _ := s.config.RewardSchedule.BlockReward(t.Height)
+    if cfg.Full {
+        blockReward.Add(blockReward, big.NewInt(s.txFees.average()))
+    }
+    value := new(big.Rat).SetFrac(blockReward.Mul(blockReward, big.NewInt(shareDiff)), t.Difficulty)
+    value.Mul(value, new(big.Rat).SetFloat64(1-cfg.Fee/100))
+    n, _ := strconv.ParseInt(value.FloatString(0), 10, 64)
+    return n
+}
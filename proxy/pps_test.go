@@ -0,0 +1,71 @@
+package proxy
+
+import (
+    "math/big"
+    "testing"
+)
+
+func TestTxFeesAverage(t *testing.T) {
+    f := newTxFees(&PPS{FeeBlocks: 3})
+    if avg := f.average(); avg != 0 {
+        t.Fatalf("average() of no blocks = %v, want 0", avg)
+    }
+    // Only the last 3 blocks are averaged, oldest fee is replaced once buffer is full
+    blocks := []struct {
+        height    uint64
+        fee       int64
+        average   int64
+    }{
+        {10, 100, 100},
+        {11, 200, 150},
+        {12, 600, 300},
+        {13, 400, 400},
+        {14, 500, 500},
+        {15, 0, 300},
+        {16, 0, 166},
+        {17, 900, 300},
+    }
+    for _, b := range blocks {
+        f.add(b.height, b.fee)
+        if avg := f.average(); avg != b.average {
+            t.Errorf("average() after block %v = %v, want %v", b.height, avg, b.average)
+        }
+        if h := f.lastHeight(); h != b.height {
+            t.Errorf("lastHeight() = %v, want %v", h, b.height)
+        }
+    }
+}
+
+func TestShareValue(t *testing.T) {
+    // Block reward is 300000000 at this height
+    template := &BlockTemplate{Height: 100, Difficulty: big.NewInt(1000000)}
+    fees := []int64{1000000, 3000000}
+
+    tests := []struct {
+        name      string
+        pps       PPS
+        fees      []int64
+        diff      int64
+        expected  int64
+    }{
+        {"no fee", PPS{Enabled: true}, nil, 1000, 300000},
+        {"fee deducted", PPS{Enabled: true, Fee: 1}, nil, 1000, 297000},
+        {"share of network difficulty", PPS{Enabled: true, Fee: 2}, nil, 1000000, 294000000},
+        {"rounded", PPS{Enabled: true}, nil, 1, 300},
+        {"fees not paid without full", PPS{Enabled: true}, fees, 1000, 300000},
+        {"fpps adds average fees", PPS{Enabled: true, Full: true}, fees, 1000, 302000},
+        {"fpps fee deducted", PPS{Enabled: true, Full: true, Fee: 1}, fees, 1000, 298980},
+        {"fpps without known fees", PPS{Enabled: true, Full: true}, nil, 1000, 300000},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            s := &ProxyServer{config: &Config{Proxy: Proxy{PPS: tt.pps}}, txFees: newTxFees(&tt.pps)}
+            for i, fee := range tt.fees {
+                s.txFees.add(uint64(i), fee)
+            }
+            if got := s.shareValue(tt.diff, template); got != tt.expected {
+                t.Errorf("shareValue(%v) = %v, want %v", tt.diff, got, tt.expected)
+            }
+        })
+    }
+}
@@ -19,6 +19,12 @@ type JSONPushMessage struct {
     Result    interface{}       `json:"result"`
 }
 
+type JSONStratumNotification struct {
+    Id        interface{}       `json:"id"`
+    Method    string            `json:"method"`
+    Params    interface{}       `json:"params"`
+}
+
 type JSONRpcResp struct {
     Id         json.RawMessage  `json:"id"`
     Version    string           `json:"jsonrpc"`
@@ -33,4 +39,6 @@ type SubmitReply struct {
 type ErrorReply struct {
     Code       int              `json:"code"`
     Message    string           `json:"message"`
+    // Stratum session stays open after this error is sent
+    keepAlive  bool
 }
@@ -1,9 +1,11 @@
 package proxy
 
 import (
+    "context"
     "encoding/json"
     "io"
     "log"
+    "math/rand"
     "net"
     "net/http"
     "sync"
@@ -19,10 +21,16 @@ import (
 )
 
 type StratumServer struct {
+    // Accessed atomically, so keep them first in order to avoid alignment issue
+    fanoutCount   int64
+    fanoutSum     int64
+    fanoutMax     int64
+
     sessionsMu    sync.RWMutex
     sessions      map[*Session]struct{}
     timeout       time.Duration
-    diff          string
+    varDiff       *varDiff
+    listener      *net.TCPListener
 }
 
 type ProxyServer struct {
@@ -30,21 +38,64 @@ type ProxyServer struct {
     blockTemplate           atomic.Value
     upstream                int32
     upstreams               []*rpc.RPCClient
+    upstreamStates          []*upstreamState
+    pendingUpstream         int
+    pendingChecks           int
     backend                 *storage.RedisClient
     policy                  *policy.PolicyServer
     hashrateExpiration      time.Duration
     failsCount              int64
     stratum                 []*StratumServer
+    templatesMu             sync.RWMutex
+    templates               []*BlockTemplate
+    maxTemplates            int
+    staleShareGrace         time.Duration
+    shareWriter             *shareWriter
+    verifier                *verifier
+    txFees                  *txFees
+    longPollTimeout         time.Duration
+    workMu                  sync.Mutex
+    workCh                  chan struct{}
+    httpServer              *http.Server
+    adminServer             *http.Server
+    notifyServer            *http.Server
+    blockNotify             chan struct{}
+    stopping                int32
+    // Last allocated extranonce, starts at random value so proxies sharing a node likely don't overlap
+    extraNonce              uint32
+    // Held for reading while a stratum request is being processed
+    requestsMu              sync.RWMutex
 }
 
 type Session struct {
+    // Accessed atomically, so keep them first in order to avoid alignment issue
+    lastShareAt     int64
+    accepted        int64
+    rejected        int64
+
     s_id        int
     ip          string
     enc         *json.Encoder
 
     sync.Mutex
-    conn        *net.TCPConn
+    conn        net.Conn
+    extraNonce  string
+    out         chan *jobMessage
+    done        chan struct{}
+
+    // Set by connection goroutine on every login, other goroutines must use identity()
+    loginMu     sync.RWMutex
     login       string
+    worker      string
+    solo        bool
+
+    diffMu          sync.RWMutex
+    diff            int64
+    prevDiff        int64
+    target          string
+    shares          int64
+    lastRetarget    time.Time
+    connectedAt     int64
 }
 
 func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
@@ -53,32 +104,93 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
     }
     policy := policy.Start(&cfg.Proxy.Policy, backend)
 
-    proxy := &ProxyServer{config: cfg, backend: backend, policy: policy}
+    proxy := &ProxyServer{config: cfg, backend: backend, policy: policy, maxTemplates: 1, extraNonce: rand.Uint32()}
+    if cfg.Proxy.MaxTemplates > 1 {
+        proxy.maxTemplates = cfg.Proxy.MaxTemplates
+    }
+    if len(cfg.Proxy.StaleShareGrace) > 0 {
+        proxy.staleShareGrace = util.MustParseDuration(cfg.Proxy.StaleShareGrace)
+    }
+    if len(cfg.Proxy.LongPollTimeout) > 0 {
+        proxy.longPollTimeout = util.MustParseDuration(cfg.Proxy.LongPollTimeout)
+    }
+    proxy.workCh = make(chan struct{})
+    proxy.blockNotify = make(chan struct{}, 1)
+    proxy.hashrateExpiration = util.MustParseDuration(cfg.Proxy.HashrateExpiration)
+    proxy.verifier = newVerifier(&cfg.Proxy.Verifier)
+    proxy.txFees = newTxFees(&cfg.Proxy.PPS)
+    if cfg.Proxy.PPS.Enabled {
+        if cfg.Proxy.ShareLog {
+            log.Fatal("PPS and shareLog can't be enabled at once")
+        }
+        if err := cfg.RewardSchedule.Check(); err != nil {
+            log.Fatal(err)
+        }
+        if _, ok := cfg.RewardSchedule.BlockReward(0); !ok {
+            log.Fatal("PPS needs reward schedule with known rewards, coinbase source can't be used")
+        }
+    }
+    proxy.checkPayoutScheme()
+    proxy.shareWriter = newShareWriter(cfg.Proxy.Name, &cfg.Proxy.ShareWriter, backend, proxy.hashrateExpiration, cfg.Proxy.SharedBackend, cfg.Proxy.ShareLog)
     proxy.upstreams = make([]*rpc.RPCClient, len(cfg.Upstream))
+    proxy.upstreamStates = make([]*upstreamState, len(cfg.Upstream))
+    proxy.pendingUpstream = -1
     
     for i, v := range cfg.Upstream {
         proxy.upstreams[i] = rpc.NewRPCClient(v.Name, v.Url, cfg.Account, cfg.Password, v.Timeout)
+        proxy.upstreamStates[i] = &upstreamState{}
         log.Printf("Upstream: %s => %s", v.Name, v.Url)
     }
+    switch cfg.UpstreamPolicy.Strategy {
+    case "", UpstreamPriority, UpstreamHeight, UpstreamLatency:
+    default:
+        log.Fatalf("Unsupported upstream strategy %s", cfg.UpstreamPolicy.Strategy)
+    }
     log.Printf("Default upstream: %s => %s", proxy.rpc().Name, proxy.rpc().Url)
 
     proxy.stratum = make([]*StratumServer, len(cfg.Proxy.Stratum))
     log.Printf("Total StratumServer count: %d", len(cfg.Proxy.Stratum))
     for i, st := range cfg.Proxy.Stratum {
-        stratumserver := StratumServer{sessions: make(map[*Session]struct{}), diff: util.GetTargetHex(st.Difficulty)}
+        switch st.Protocol {
+        case "", EthProxy, EthereumStratum:
+        default:
+            log.Fatalf("Unsupported protocol %s on stratum %s", st.Protocol, st.Name)
+        }
+        stratumserver := StratumServer{sessions: make(map[*Session]struct{})}
+        if st.VarDiff.Enabled {
+            stratumserver.varDiff = newVarDiff(&cfg.Proxy.Stratum[i].VarDiff)
+        }
         proxy.stratum[i] = &stratumserver
         if st.Enabled {
             go proxy.ListenTCP(i)
         }
     }
     
+    r := mux.NewRouter()
+    r.Handle("/{login:M[A-Z0-9]{1}[0-9a-zA-Z]{32}}/{id:[0-9a-zA-Z-_]{1,8}}", proxy)
+    r.Handle("/{login:M[A-Z0-9]{1}[0-9a-zA-Z]{32}}.{id:[0-9a-zA-Z-_]{1,8}}", proxy)
+    r.Handle("/{login:M[A-Z0-9]{1}[0-9a-zA-Z]{32}}", proxy)
+    proxy.httpServer = &http.Server{
+        Addr:           cfg.Proxy.Listen,
+        Handler:        r,
+        MaxHeaderBytes: cfg.Proxy.LimitHeadersSize,
+    }
+
+    if cfg.Proxy.Admin.Enabled {
+        proxy.startAdmin()
+    }
+
     proxy.rpc().SetAddress(cfg.Proxy.Address)
+    backend.WriteUpstreamState(cfg.Proxy.Name, proxy.rpc().Name, "startup")
 
     proxy.fetchBlockTemplate()
 
-    proxy.hashrateExpiration = util.MustParseDuration(cfg.Proxy.HashrateExpiration)
-
     refreshIntv := util.MustParseDuration(cfg.Proxy.BlockRefreshInterval)
+    if cfg.Proxy.BlockNotify.Enabled {
+        // Polling is only a fallback for missed notifications
+        refreshIntv = util.MustParseDuration(cfg.Proxy.BlockNotify.FallbackInterval)
+        proxy.startBlockNotify()
+    }
     refreshTimer := time.NewTimer(refreshIntv)
     log.Printf("Set block refresh every %v", refreshIntv)
 
@@ -94,6 +206,8 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
             case <-refreshTimer.C:
                 proxy.fetchBlockTemplate()
                 refreshTimer.Reset(refreshIntv)
+            case <-proxy.blockNotify:
+                proxy.fetchBlockTemplate()
             }
         }
     }()
@@ -114,7 +228,8 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
             case <-stateUpdateTimer.C:
                 t := proxy.currentBlockTemplate()
                 if t != nil {
-                    err := backend.WriteNodeState(cfg.Proxy.Name, t.Height, t.Difficulty)
+                    err := backend.WriteNodeState(cfg.Proxy.Name, t.Height, t.Difficulty, proxy.shareWriter.queueDepth(),
+                        proxy.verifier.queueDepth(), proxy.verifier.resetLatency())
                     if err != nil {
                         log.Printf("Failed to write node state to backend: %v", err)
                         proxy.markSick()
@@ -132,42 +247,95 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 
 func (s *ProxyServer) Start() {
     log.Printf("Starting proxy on %v", s.config.Proxy.Listen)
-    r := mux.NewRouter()
-    r.Handle("/{login:M[A-Z0-9]{1}[0-9a-zA-Z]{32}}}/{id:[0-9a-zA-Z-_]{1,8}}", s)
-    r.Handle("/{login:M[A-Z0-9]{1}[0-9a-zA-Z]{32}}", s)
-    srv := &http.Server{
-        Addr:           s.config.Proxy.Listen,
-        Handler:        r,
-        MaxHeaderBytes: s.config.Proxy.LimitHeadersSize,
-    }
-    err := srv.ListenAndServe()
-    if err != nil {
+    err := s.httpServer.ListenAndServe()
+    if err != nil && err != http.ErrServerClosed {
         log.Fatalf("Failed to start proxy: %v", err)
     }
 }
 
-func (s *ProxyServer) rpc() *rpc.RPCClient {
-    i := atomic.LoadInt32(&s.upstream)
-    return s.upstreams[i]
-}
+// Stops accepting new connections and waits for in-flight requests before closing stratum sessions
+func (s *ProxyServer) Stop(ctx context.Context) {
+    atomic.StoreInt32(&s.stopping, 1)
+    // Release long polling requests, otherwise HTTP server waits for them
+    s.notifyNewWork()
+
+    for i, stratum := range s.stratum {
+        stratum.sessionsMu.RLock()
+        listener := stratum.listener
+        stratum.sessionsMu.RUnlock()
+        if listener != nil {
+            listener.Close()
+            log.Printf("Stratum %s stopped accepting connections", s.config.Proxy.Stratum[i].Name)
+        }
+    }
+
+    err := s.httpServer.Shutdown(ctx)
+    if err != nil {
+        log.Printf("Failed to stop proxy: %v", err)
+    }
+    if s.adminServer != nil {
+        s.adminServer.Shutdown(ctx)
+    }
+    if s.notifyServer != nil {
+        s.notifyServer.Shutdown(ctx)
+    }
 
-func (s *ProxyServer) checkUpstreams() {
-    candidate := int32(0)
-    backup := false
+    s.requestsMu.Lock()
+    s.requestsMu.Unlock()
+    s.shareWriter.stop(ctx)
 
-    for i, v := range s.upstreams {
-        if v.Check() && !backup {
-            candidate = int32(i)
-            backup = true
+    total := 0
+    for _, stratum := range s.stratum {
+        stratum.sessionsMu.Lock()
+        for cs := range stratum.sessions {
+            cs.conn.Close()
+            total++
         }
+        stratum.sessionsMu.Unlock()
     }
+    log.Printf("Proxy stopped, closed %v stratum sessions", total)
+}
 
-    if s.upstream != candidate {
-        log.Printf("Switching to %v upstream", s.upstreams[candidate].Name)
-        atomic.StoreInt32(&s.upstream, candidate)
+// Proxies and unlocker must agree on payout scheme, the first one started sets it in backend
+func (s *ProxyServer) checkPayoutScheme() {
+    scheme := storage.SchemeProp
+    if s.config.Proxy.PPS.Enabled {
+        scheme = storage.SchemePPS
+    } else if s.config.Proxy.ShareLog {
+        scheme = storage.SchemePPLNS
+    }
+    current, _, err := s.backend.ClaimPayoutScheme(scheme)
+    if err != nil {
+        log.Fatalf("Unable to check payout scheme in backend: %v", err)
+    }
+    if current != scheme {
+        log.Fatalf("Proxy is set up for %s, but backend is set to %s, see docs/PAYOUTS.md to switch", scheme, current)
     }
 }
 
+func (s *ProxyServer) isStopping() bool {
+    return atomic.LoadInt32(&s.stopping) > 0
+}
+
+// Returns false once proxy is shutting down, otherwise endRequest must be called after processing
+func (s *ProxyServer) beginRequest() bool {
+    s.requestsMu.RLock()
+    if s.isStopping() {
+        s.requestsMu.RUnlock()
+        return false
+    }
+    return true
+}
+
+func (s *ProxyServer) endRequest() {
+    s.requestsMu.RUnlock()
+}
+
+func (s *ProxyServer) rpc() *rpc.RPCClient {
+    i := atomic.LoadInt32(&s.upstream)
+    return s.upstreams[i]
+}
+
 func (s *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
     if r.Method != "POST" {
         s.writeError(w, 405, "rpc: POST method required, received "+r.Method)
@@ -200,7 +368,12 @@ func (s *ProxyServer) handleClient(w http.ResponseWriter, r *http.Request, ip st
     r.Body = http.MaxBytesReader(w, r.Body, s.config.Proxy.LimitBodySize)
     defer r.Body.Close()
 
+    if s.longPollTimeout > 0 {
+        w.Header().Set("X-Long-Polling", r.URL.Path)
+    }
+
     cs := &Session{ip: ip, enc: json.NewEncoder(w)}
+    cs.setDifficulty(s.config.Proxy.Stratum[cs.s_id].Difficulty)
     dec := json.NewDecoder(r.Body)
     for {
         var req JSONRpcReq
@@ -224,6 +397,7 @@ func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req *JSONRpcRe
 
     vars := mux.Vars(r)
     login := vars["login"]
+    id := cs.workerId(vars["id"])
 
     if !s.policy.ApplyLoginPolicy(login, cs.ip) {
         errReply := &ErrorReply{Code: -1, Message: "You are blacklisted"}
@@ -234,6 +408,9 @@ func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req *JSONRpcRe
     // Handle RPC methods
     switch req.Method {
     case "eth_getWork":
+        if s.isLongPoll(r) {
+            s.waitNewWork(r)
+        }
         reply, errReply := s.handleGetWorkRPC(cs)
         if errReply != nil {
             cs.sendError(req.Id, errReply)
@@ -249,7 +426,7 @@ func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req *JSONRpcRe
                 s.policy.ApplyMalformedPolicy(cs.ip)
                 break
             }
-            reply, errReply := s.handleSubmitRPC(cs, login, vars["id"], params)
+            reply, errReply := s.handleSubmitRPC(cs, login, id, params)
             if errReply != nil {
                 cs.sendError(req.Id, errReply)
                 break
@@ -265,7 +442,15 @@ func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req *JSONRpcRe
         reply := s.handleGetBlockByNumberRPC()
         cs.sendResult(req.Id, reply)
     case "eth_submitHashrate":
-        cs.sendResult(req.Id, true)
+        var params []string
+        err := json.Unmarshal(req.Params, &params)
+        if err != nil {
+            log.Printf("Unable to parse params from %v", cs.ip)
+            s.policy.ApplyMalformedPolicy(cs.ip)
+            break
+        }
+        reply := s.handleSubmitHashrateRPC(cs, login, id, params)
+        cs.sendResult(req.Id, reply)
     default:
         errReply := s.handleUnknownRPC(cs, req.Method)
         cs.sendError(req.Id, errReply)
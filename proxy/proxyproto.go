@@ -0,0 +1,155 @@
+package proxy
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "strings"
+    "time"
+)
+
+// Load balancer must send PROXY header right after connect
+const proxyHeaderTimeout = 5 * time.Second
+
+var (
+    proxyV1Prefix = []byte("PROXY ")
+    proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+    errProxyHeader = errors.New("Malformed PROXY protocol header")
+)
+
+// Connection with PROXY header consumed, buffered remainder is read first
+type proxyConn struct {
+    net.Conn
+    reader *bufio.Reader
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+    return c.reader.Read(b)
+}
+
+func parseTrustedProxies(cidrs []string) ([]*net.IPNet, error) {
+    trusted := make([]*net.IPNet, 0, len(cidrs))
+    for _, cidr := range cidrs {
+        _, ipNet, err := net.ParseCIDR(cidr)
+        if err != nil {
+            return nil, fmt.Errorf("Invalid trusted proxy %s: %v", cidr, err)
+        }
+        trusted = append(trusted, ipNet)
+    }
+    return trusted, nil
+}
+
+func isTrustedProxy(trusted []*net.IPNet, ip string) bool {
+    addr := net.ParseIP(ip)
+    if addr == nil {
+        return false
+    }
+    for _, ipNet := range trusted {
+        if ipNet.Contains(addr) {
+            return true
+        }
+    }
+    return false
+}
+
+// Reads PROXY v1 or v2 header and returns connection positioned after it and the client IP.
+// For LOCAL and UNKNOWN headers (health checks) balancer's IP is returned.
+func readProxyHeader(conn net.Conn, ip string) (net.Conn, string, error) {
+    conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+    reader := bufio.NewReaderSize(conn, 256)
+    // Bare v1 health check header may be all balancer sends, don't wait for more than its prefix
+    prefix, err := reader.Peek(len(proxyV1Prefix))
+    if err != nil {
+        return nil, "", err
+    }
+
+    var clientIp string
+    if bytes.Equal(prefix, proxyV1Prefix) {
+        clientIp, err = readProxyV1(reader)
+    } else if isProxyV2(reader) {
+        clientIp, err = readProxyV2(reader)
+    } else {
+        err = errProxyHeader
+    }
+    if err != nil {
+        return nil, "", err
+    }
+    if len(clientIp) == 0 {
+        clientIp = ip
+    }
+    return &proxyConn{Conn: conn, reader: reader}, clientIp, nil
+}
+
+// Longer v2 signature is only peeked once v1 is ruled out
+func isProxyV2(reader *bufio.Reader) bool {
+    sig, err := reader.Peek(len(proxyV2Signature))
+    return err == nil && bytes.Equal(sig, proxyV2Signature)
+}
+
+// PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func readProxyV1(reader *bufio.Reader) (string, error) {
+    line, err := reader.ReadSlice('\n')
+    if err != nil {
+        return "", errProxyHeader
+    }
+    // Header is 107 bytes at most
+    if len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+        return "", errProxyHeader
+    }
+    fields := strings.Fields(string(line))
+    if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+        return "", nil
+    }
+    if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+        return "", errProxyHeader
+    }
+    addr := net.ParseIP(fields[2])
+    if addr == nil {
+        return "", errProxyHeader
+    }
+    return addr.String(), nil
+}
+
+// 12 bytes signature, version and command, family, address length and addresses
+func readProxyV2(reader *bufio.Reader) (string, error) {
+    header := make([]byte, 16)
+    _, err := io.ReadFull(reader, header)
+    if err != nil {
+        return "", err
+    }
+    if header[12]>>4 != 2 {
+        return "", errProxyHeader
+    }
+    payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+    _, err = io.ReadFull(reader, payload)
+    if err != nil {
+        return "", err
+    }
+
+    command := header[12] & 0xf
+    if command == 0x0 {
+        // LOCAL command, connection is made by balancer itself
+        return "", nil
+    } else if command != 0x1 {
+        return "", errProxyHeader
+    }
+    switch header[13] {
+    case 0x11, 0x12:
+        if len(payload) < 12 {
+            return "", errProxyHeader
+        }
+        return net.IP(payload[:4]).String(), nil
+    case 0x21, 0x22:
+        if len(payload) < 36 {
+            return "", errProxyHeader
+        }
+        return net.IP(payload[:16]).String(), nil
+    default:
+        // Unix sockets and unspecified family
+        return "", nil
+    }
+}
@@ -0,0 +1,165 @@
+package proxy
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "io"
+    "net"
+    "testing"
+)
+
+func proxyV2Header(command, family byte, payload []byte) []byte {
+    header := append([]byte{}, proxyV2Signature...)
+    header = append(header, 0x20|command, family, 0, 0)
+    binary.BigEndian.PutUint16(header[14:16], uint16(len(payload)))
+    return append(header, payload...)
+}
+
+func TestReadProxyV1(t *testing.T) {
+    tests := []struct {
+        name      string
+        header    string
+        ip        string
+        err       bool
+    }{
+        {"tcp4", "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n", "192.168.0.1", false},
+        {"tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "2001:db8::1", false},
+        {"unknown", "PROXY UNKNOWN\r\n", "", false},
+        {"unknown with addresses", "PROXY UNKNOWN 192.168.0.1 192.168.0.11 56324 443\r\n", "", false},
+        {"missing cr", "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\n", "", true},
+        {"missing fields", "PROXY TCP4 192.168.0.1 192.168.0.11\r\n", "", true},
+        {"bad protocol", "PROXY UDP4 192.168.0.1 192.168.0.11 56324 443\r\n", "", true},
+        {"bad address", "PROXY TCP4 192.168.0 192.168.0.11 56324 443\r\n", "", true},
+        {"no newline", "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443", "", true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ip, err := readProxyV1(bufio.NewReader(bytes.NewBufferString(tt.header)))
+            if (err != nil) != tt.err {
+                t.Fatalf("readProxyV1() error = %v, want error %v", err, tt.err)
+            }
+            if ip != tt.ip {
+                t.Errorf("readProxyV1() = %q, want %q", ip, tt.ip)
+            }
+        })
+    }
+}
+
+func TestReadProxyV2(t *testing.T) {
+    ipv4 := append(net.ParseIP("10.0.0.1").To4(), net.ParseIP("10.0.0.2").To4()...)
+    ipv4 = append(ipv4, 0xdc, 0x04, 0x01, 0xbb)
+    ipv6 := append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...)
+    ipv6 = append(ipv6, 0xdc, 0x04, 0x01, 0xbb)
+
+    tests := []struct {
+        name      string
+        header    []byte
+        ip        string
+        err       bool
+    }{
+        {"proxy tcp4", proxyV2Header(0x1, 0x11, ipv4), "10.0.0.1", false},
+        {"proxy udp4", proxyV2Header(0x1, 0x12, ipv4), "10.0.0.1", false},
+        {"proxy tcp6", proxyV2Header(0x1, 0x21, ipv6), "2001:db8::1", false},
+        {"local", proxyV2Header(0x0, 0x00, nil), "", false},
+        {"unix socket", proxyV2Header(0x1, 0x31, make([]byte, 216)), "", false},
+        {"unknown command", proxyV2Header(0x2, 0x11, ipv4), "", true},
+        {"short tcp4", proxyV2Header(0x1, 0x11, ipv4[:8]), "", true},
+        {"short tcp6", proxyV2Header(0x1, 0x21, ipv6[:20]), "", true},
+        {"truncated payload", proxyV2Header(0x1, 0x11, ipv4)[:20], "", true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ip, err := readProxyV2(bufio.NewReader(bytes.NewReader(tt.header)))
+            if (err != nil) != tt.err {
+                t.Fatalf("readProxyV2() error = %v, want error %v", err, tt.err)
+            }
+            if ip != tt.ip {
+                t.Errorf("readProxyV2() = %q, want %q", ip, tt.ip)
+            }
+        })
+    }
+
+    header := proxyV2Header(0x1, 0x11, ipv4)
+    header[12] = 0x11
+    if _, err := readProxyV2(bufio.NewReader(bytes.NewReader(header))); err == nil {
+        t.Error("readProxyV2() accepted version 1")
+    }
+}
+
+func TestReadProxyHeader(t *testing.T) {
+    request := []byte("{\"id\":1}\n")
+    ipv4 := append(net.ParseIP("10.0.0.1").To4(), 10, 0, 0, 2, 0xdc, 0x04, 0x01, 0xbb)
+    tests := []struct {
+        name      string
+        header    []byte
+        rest      []byte
+        ip        string
+        err       bool
+    }{
+        {"v1", []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"), request, "192.168.0.1", false},
+        {"v1 unknown", []byte("PROXY UNKNOWN\r\n"), request, "127.0.0.1", false},
+        {"v1 unknown health check", []byte("PROXY UNKNOWN\r\n"), nil, "127.0.0.1", false},
+        {"v2", proxyV2Header(0x1, 0x11, ipv4), request, "10.0.0.1", false},
+        {"v2 local", proxyV2Header(0x0, 0x00, nil), request, "127.0.0.1", false},
+        {"v2 local health check", proxyV2Header(0x0, 0x00, nil), nil, "127.0.0.1", false},
+        {"no header", []byte("{\"id\":1,\"method\":\"eth_submitLogin\"}\n"), nil, "", true},
+        {"short", []byte("PROX"), nil, "", true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            client, server := net.Pipe()
+            defer server.Close()
+            defer client.Close()
+            go func() {
+                client.Write(append(append([]byte{}, tt.header...), tt.rest...))
+                // Balancer keeps connection open after health check header, malformed ones are closed
+                if tt.err {
+                    client.Close()
+                }
+            }()
+
+            conn, ip, err := readProxyHeader(server, "127.0.0.1")
+            if (err != nil) != tt.err {
+                t.Fatalf("readProxyHeader() error = %v, want error %v", err, tt.err)
+            }
+            if tt.err {
+                return
+            }
+            if ip != tt.ip {
+                t.Errorf("readProxyHeader() ip = %q, want %q", ip, tt.ip)
+            }
+            // Data after header must be readable from returned connection
+            buf := make([]byte, len(tt.rest))
+            if _, err := io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, tt.rest) {
+                t.Errorf("read after header = %q, %v, want %q", buf, err, tt.rest)
+            }
+        })
+    }
+}
+
+func TestTrustedProxies(t *testing.T) {
+    trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "2001:db8::/32"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct {
+        ip        string
+        expected  bool
+    }{
+        {"10.1.2.3", true},
+        {"11.1.2.3", false},
+        {"2001:db8::5", true},
+        {"2001:db9::5", false},
+        {"invalid", false},
+    }
+    for _, tt := range tests {
+        if got := isTrustedProxy(trusted, tt.ip); got != tt.expected {
+            t.Errorf("isTrustedProxy(%q) = %v, want %v", tt.ip, got, tt.expected)
+        }
+    }
+
+    if _, err := parseTrustedProxies([]string{"10.0.0.1"}); err == nil {
+        t.Error("parseTrustedProxies() accepted address without mask")
+    }
+}
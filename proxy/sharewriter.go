@@ -0,0 +1,242 @@
+package proxy
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "sync/atomic"
+    "time"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/storage"
+    "github.com/NotoriousPyro/open-metaverse-pool/util"
+)
+
+const (
+    defaultShareBufferSize = 10000
+    defaultShareBatchSize = 500
+    defaultShareFlushInterval = 100 * time.Millisecond
+)
+
+// Queues accepted shares and writes them to backend in batches,
+// so backend latency doesn't delay replies to miners.
+type shareWriter struct {
+    // Accessed atomically, so keep it first in order to avoid alignment issue
+    lastFullWarn    int64
+
+    backend         *storage.RedisClient
+    // Batch ids are unique across proxies and restarts, a retried batch keeps its id
+    batchPrefix     string
+    batchSeq        int64
+    queue           chan *storage.Share
+    batchSize       int
+    flushInterval   time.Duration
+    expire          time.Duration
+    // Requests to write queued shares at once, closed channel is the reply
+    syncs           chan chan struct{}
+    // Closed by stop, queued shares are written and run returns
+    quit            chan struct{}
+    // Closed once shutdown times out, write retries are given up
+    abort           chan struct{}
+    done            chan struct{}
+    // Other proxies write to the same backend, so duplicates are checked there as well
+    shared          bool
+    shareLog        bool
+}
+
+func newShareWriter(name string, cfg *ShareWriter, backend *storage.RedisClient, expire time.Duration, shared, shareLog bool) *shareWriter {
+    w := &shareWriter{
+        backend:       backend,
+        batchPrefix:   fmt.Sprintf("%s:%d", name, time.Now().UnixNano()),
+        queue:         make(chan *storage.Share, defaultShareBufferSize),
+        batchSize:     defaultShareBatchSize,
+        flushInterval: defaultShareFlushInterval,
+        expire:        expire,
+        syncs:         make(chan chan struct{}),
+        quit:          make(chan struct{}),
+        abort:         make(chan struct{}),
+        done:          make(chan struct{}),
+        shared:        shared,
+        shareLog:      shareLog,
+    }
+    if cfg.BufferSize > 0 {
+        w.queue = make(chan *storage.Share, cfg.BufferSize)
+    }
+    if cfg.BatchSize > 0 {
+        w.batchSize = cfg.BatchSize
+    }
+    if len(cfg.FlushInterval) > 0 {
+        w.flushInterval = util.MustParseDuration(cfg.FlushInterval)
+    }
+    log.Printf("Share writer buffers %v shares, writes up to %v every %v", cap(w.queue), w.batchSize, w.flushInterval)
+    go w.run()
+    return w
+}
+
+// Blocks while queue is full, so miners are slowed down instead of losing shares.
+// Shares submitted after stop are dropped.
+func (w *shareWriter) enqueue(share *storage.Share) {
+    select {
+    case <-w.quit:
+        log.Printf("Share writer stopped, dropping share from %v.%v", share.Login, share.Id)
+        return
+    default:
+    }
+    select {
+    case w.queue <- share:
+        return
+    default:
+    }
+    now := util.MakeTimestamp()
+    last := atomic.LoadInt64(&w.lastFullWarn)
+    if now-last > 10000 && atomic.CompareAndSwapInt64(&w.lastFullWarn, last, now) {
+        log.Printf("Share queue is full with %v shares, backend is too slow", len(w.queue))
+    }
+    select {
+    case w.queue <- share:
+    case <-w.quit:
+        log.Printf("Share writer stopped, dropping share from %v.%v", share.Login, share.Id)
+    }
+}
+
+// Returns once shares queued before the call are written,
+// so a found block closes the round after all shares accepted before it
+func (w *shareWriter) sync() {
+    reply := make(chan struct{})
+    select {
+    case w.syncs <- reply:
+        <-reply
+    case <-w.done:
+    }
+}
+
+func (w *shareWriter) queueDepth() int {
+    return len(w.queue)
+}
+
+func (w *shareWriter) run() {
+    defer close(w.done)
+    batch := make([]*storage.Share, 0, w.batchSize)
+    timer := time.NewTimer(w.flushInterval)
+
+    for {
+        select {
+        case share := <-w.queue:
+            batch = append(batch, share)
+            if len(batch) < w.batchSize {
+                continue
+            }
+        case <-timer.C:
+            timer.Reset(w.flushInterval)
+        case reply := <-w.syncs:
+            w.flushAll(w.drain(batch))
+            batch = batch[:0]
+            close(reply)
+            continue
+        case <-w.quit:
+            timer.Stop()
+            w.flushAll(w.drain(batch))
+            return
+        }
+        if len(batch) > 0 {
+            w.flush(batch)
+            batch = batch[:0]
+        }
+    }
+}
+
+// Takes shares left in queue without waiting for more
+func (w *shareWriter) drain(batch []*storage.Share) []*storage.Share {
+    for {
+        select {
+        case share := <-w.queue:
+            batch = append(batch, share)
+        default:
+            return batch
+        }
+    }
+}
+
+func (w *shareWriter) flushAll(batch []*storage.Share) {
+    for len(batch) > 0 {
+        n := len(batch)
+        if n > w.batchSize {
+            n = w.batchSize
+        }
+        w.flush(batch[:n])
+        batch = batch[n:]
+    }
+}
+
+// Waits before retrying write, false if shutdown timed out meanwhile
+func (w *shareWriter) wait() bool {
+    select {
+    case <-time.After(w.flushInterval):
+        return true
+    case <-w.abort:
+        return false
+    }
+}
+
+// Retries until batch is written, queue fills up meanwhile and applies backpressure.
+// Gives up only once shutdown timed out.
+func (w *shareWriter) flush(batch []*storage.Share) {
+    w.batchSeq++
+    batchId := fmt.Sprintf("%s:%d", w.batchPrefix, w.batchSeq)
+    shares := batch
+    if w.shared {
+        shares = w.skipExisting(batchId, batch)
+        if len(shares) == 0 {
+            return
+        }
+    }
+
+    for {
+        err := w.backend.WriteShares(batchId, shares, w.expire, w.shareLog)
+        if err == nil {
+            return
+        }
+        log.Printf("Failed to write %v shares to backend, retrying: %v", len(shares), err)
+        if !w.wait() {
+            log.Printf("Share writer stopped with %v shares not written", len(shares))
+            return
+        }
+    }
+}
+
+// Drops shares already submitted to another proxy, retried check of the batch keeps its own shares
+func (w *shareWriter) skipExisting(batchId string, batch []*storage.Share) []*storage.Share {
+    var exist []bool
+    for {
+        var err error
+        exist, err = w.backend.CheckSharesExist(batchId, batch)
+        if err == nil {
+            break
+        }
+        log.Printf("Failed to check %v shares in backend, retrying: %v", len(batch), err)
+        if !w.wait() {
+            return batch
+        }
+    }
+
+    shares := make([]*storage.Share, 0, len(batch))
+    for i, share := range batch {
+        if exist[i] {
+            log.Printf("Duplicate share from %v.%v submitted to another proxy, skipping", share.Login, share.Id)
+            continue
+        }
+        shares = append(shares, share)
+    }
+    return shares
+}
+
+// Writes queued shares until ctx is done, shares submitted meanwhile are dropped
+func (w *shareWriter) stop(ctx context.Context) {
+    close(w.quit)
+    select {
+    case <-w.done:
+        log.Printf("Share writer flushed all shares")
+    case <-ctx.Done():
+        close(w.abort)
+        log.Printf("Share writer stopped with %v shares not written", len(w.queue))
+    }
+}
@@ -2,11 +2,13 @@ package proxy
 
 import (
     "bufio"
+    "crypto/tls"
     "encoding/json"
     "errors"
     "io"
     "log"
     "net"
+    "sync/atomic"
     "time"
 
     "github.com/NotoriousPyro/open-metaverse-pool/util"
@@ -14,6 +16,9 @@ import (
 
 const (
     MaxReqSize = 1024
+    // Jobs queued for a session before it's considered too slow and dropped
+    MaxQueuedJobs = 8
+    JobWriteTimeout = 10 * time.Second
 )
 
 func (s *ProxyServer) ListenTCP(s_id int) {
@@ -30,41 +35,100 @@ func (s *ProxyServer) ListenTCP(s_id int) {
         log.Fatalf("Error: %v", err)
     }
     defer server.Close()
+    s.stratum[s_id].sessionsMu.Lock()
+    s.stratum[s_id].listener = server
+    s.stratum[s_id].sessionsMu.Unlock()
+
+    var tlsConfig *tls.Config
+    if stratumConfig.TLS.Enabled {
+        tlsConfig, err = newTLSConfig(&s.config.Proxy.Stratum[s_id].TLS)
+        if err != nil {
+            log.Fatalf("Error: %v", err)
+        }
+        log.Printf("Stratum %s uses TLS with certificate %s", stratumConfig.Name, stratumConfig.TLS.CertFile)
+    }
     
-    log.Printf("Stratum %s listening on %s (Difficulty: %d)", stratumConfig.Name, stratumConfig.Listen, stratumConfig.Difficulty)
+    if stratumConfig.VarDiff.Enabled {
+        log.Printf("Stratum %s listening on %s (Difficulty: %d, VarDiff: %d-%d)", stratumConfig.Name, stratumConfig.Listen,
+            stratumConfig.Difficulty, stratumConfig.VarDiff.MinDiff, stratumConfig.VarDiff.MaxDiff)
+    } else {
+        log.Printf("Stratum %s listening on %s (Difficulty: %d)", stratumConfig.Name, stratumConfig.Listen, stratumConfig.Difficulty)
+    }
+    var trusted []*net.IPNet
+    if stratumConfig.ProxyProtocol.Enabled {
+        trusted, err = parseTrustedProxies(stratumConfig.ProxyProtocol.Trusted)
+        if err != nil {
+            log.Fatalf("Error: %v", err)
+        }
+        log.Printf("Stratum %s accepts PROXY protocol from %v", stratumConfig.Name, stratumConfig.ProxyProtocol.Trusted)
+    }
+
     var accept = make(chan int, stratumConfig.MaxConn)
     n := 0
 
     for {
-        conn, err := server.AcceptTCP()
+        tcpConn, err := server.AcceptTCP()
         if err != nil {
+            if s.isStopping() {
+                return
+            }
             continue
         }
-        conn.SetKeepAlive(true)
-
-        ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
-
-        if s.policy.IsBanned(ip) || !s.policy.ApplyLimitPolicy(ip) {
-            conn.Close()
-            continue
-        }
+        tcpConn.SetKeepAlive(true)
         n += 1
-        cs := &Session{s_id: s_id, conn: conn, ip: ip}
 
         accept <- n
-        go func(cs *Session) {
+        go func(tcpConn *net.TCPConn) {
+            defer func() { <-accept }()
+            conn, ip, err := s.acceptTCP(tcpConn, trusted, tlsConfig)
+            if err != nil {
+                tcpConn.Close()
+                return
+            }
+            cs := &Session{s_id: s_id, conn: conn, ip: ip, connectedAt: util.MakeTimestamp()}
+            cs.out = make(chan *jobMessage, MaxQueuedJobs)
+            cs.done = make(chan struct{})
+            cs.setDifficulty(s.initialDifficulty(s_id))
+
             err = s.handleTCPClient(cs)
             if err != nil {
                 s.removeSession(cs)
                 conn.Close()
             }
-            <-accept
-        }(cs)
+        }(tcpConn)
     }
 }
 
+// Resolves real client IP, applies ban and limit policy and wraps connection with TLS.
+// Connections from trusted proxies must start with PROXY header, others are served as is.
+func (s *ProxyServer) acceptTCP(tcpConn *net.TCPConn, trusted []*net.IPNet, tlsConfig *tls.Config) (net.Conn, string, error) {
+    ip, _, _ := net.SplitHostPort(tcpConn.RemoteAddr().String())
+
+    var conn net.Conn = tcpConn
+    if isTrustedProxy(trusted, ip) {
+        proxyConn, clientIp, err := readProxyHeader(tcpConn, ip)
+        if err != nil {
+            log.Printf("Failed to read PROXY header from %s: %v", ip, err)
+            return nil, "", err
+        }
+        conn, ip = proxyConn, clientIp
+    }
+
+    if s.policy.IsBanned(ip) || !s.policy.ApplyLimitPolicy(ip) {
+        return nil, "", errors.New("Connection refused by policy")
+    }
+
+    // Handshake is performed on first read under session deadline
+    if tlsConfig != nil {
+        conn = tls.Server(conn, tlsConfig)
+    }
+    return conn, ip, nil
+}
+
 func (s *ProxyServer) handleTCPClient(cs *Session) error {
     cs.enc = json.NewEncoder(cs.conn)
+    go s.sessionWriter(cs)
+    defer close(cs.done)
     connbuff := bufio.NewReaderSize(cs.conn, MaxReqSize)
     s.setDeadline(cs.conn, cs.s_id)
     stratumConfig := s.config.Proxy.Stratum[cs.s_id]
@@ -92,7 +156,11 @@ func (s *ProxyServer) handleTCPClient(cs *Session) error {
                 return err
             }
             s.setDeadline(cs.conn, cs.s_id)
+            if !s.beginRequest() {
+                return errors.New("Proxy is shutting down")
+            }
             err = cs.handleTCPMessage(s, &req)
+            s.endRequest()
             if err != nil {
                 return err
             }
@@ -103,20 +171,31 @@ func (s *ProxyServer) handleTCPClient(cs *Session) error {
 
 func (cs *Session) handleTCPMessage(s *ProxyServer, req *StratumReq) error {
     stratumConfig := s.config.Proxy.Stratum[cs.s_id]
+    if stratumConfig.Protocol == EthereumStratum {
+        return cs.handleEthStratumMessage(s, req)
+    }
     // Handle RPC methods
     switch req.Method {
         case "eth_submitLogin", "eth_login":
             var params []string
             err := json.Unmarshal(req.Params, &params)
             if err != nil {
-                log.Println("Malformed stratum request params on %s from %s", stratumConfig.Name, cs.ip)
+                log.Printf("Malformed stratum request params on %s from %s", stratumConfig.Name, cs.ip)
                 return err
             }
             reply, errReply := s.handleLoginRPC(cs, params, req.Worker)
             if errReply != nil {
                 return cs.sendTCPError(req.Id, errReply)
             }
-            return cs.sendTCPResult(req.Id, reply)
+            err = cs.sendTCPResult(req.Id, reply)
+            if err != nil || !stratumConfig.ExtraNonce {
+                return err
+            }
+            // Nonces submitted by this session must start with it
+            if len(cs.extraNonce) == 0 {
+                cs.extraNonce = s.allocExtraNonce()
+            }
+            return cs.sendTCPNotification(&JSONStratumNotification{Method: "mining.set_extranonce", Params: []string{cs.extraNonce}})
         case "eth_getWork":
             reply, errReply := s.handleGetWorkRPC(cs)
             if errReply != nil {
@@ -127,22 +206,46 @@ func (cs *Session) handleTCPMessage(s *ProxyServer, req *StratumReq) error {
             var params []string
             err := json.Unmarshal(req.Params, &params)
             if err != nil {
-                log.Println("Malformed stratum request params on %s from %s", stratumConfig.Name, cs.ip)
+                log.Printf("Malformed stratum request params on %s from %s", stratumConfig.Name, cs.ip)
                 return err
             }
             reply, errReply := s.handleTCPSubmitRPC(cs, req.Worker, params)
+            cs.recordShare(reply)
             if errReply != nil {
                 return cs.sendTCPError(req.Id, errReply)
             }
-            return cs.sendTCPResult(req.Id, &reply)
+            err = cs.sendTCPResult(req.Id, &reply)
+            if err != nil {
+                return err
+            }
+            if reply && s.retargetSession(cs, true) {
+                return s.pushSessionJob(cs)
+            }
+            return nil
         case "eth_submitHashrate":
-            return cs.sendTCPResult(req.Id, true)
+            var params []string
+            err := json.Unmarshal(req.Params, &params)
+            if err != nil {
+                log.Printf("Malformed stratum request params on %s from %s", stratumConfig.Name, cs.ip)
+                return err
+            }
+            reply := s.handleSubmitHashrateRPC(cs, cs.login, cs.workerId(req.Worker), params)
+            return cs.sendTCPResult(req.Id, reply)
         default:
             errReply := s.handleUnknownRPC(cs, req.Method)
             return cs.sendTCPError(req.Id, errReply)
     }
 }
 
+func (cs *Session) recordShare(valid bool) {
+    if valid {
+        atomic.AddInt64(&cs.accepted, 1)
+        atomic.StoreInt64(&cs.lastShareAt, util.MakeTimestamp())
+    } else {
+        atomic.AddInt64(&cs.rejected, 1)
+    }
+}
+
 func (cs *Session) sendTCPResult(id json.RawMessage, result interface{}) error {
     cs.Lock()
     defer cs.Unlock()
@@ -151,12 +254,19 @@ func (cs *Session) sendTCPResult(id json.RawMessage, result interface{}) error {
     return cs.enc.Encode(&message)
 }
 
-func (cs *Session) pushNewJob(result interface{}) error {
+func (cs *Session) sendTCPNotification(message *JSONStratumNotification) error {
     cs.Lock()
     defer cs.Unlock()
-    // FIXME: Temporarily add ID for Claymore compliance
-    message := JSONPushMessage{Version: "2.0", Result: result, Id: 0}
-    return cs.enc.Encode(&message)
+
+    return cs.enc.Encode(message)
+}
+
+func (s *ProxyServer) pushSessionJob(cs *Session) error {
+    t := s.currentBlockTemplate()
+    if t == nil || len(t.Header) == 0 || s.isSick() {
+        return nil
+    }
+    return s.sendJob(cs, t)
 }
 
 func (cs *Session) sendTCPError(id json.RawMessage, reply *ErrorReply) error {
@@ -168,10 +278,13 @@ func (cs *Session) sendTCPError(id json.RawMessage, reply *ErrorReply) error {
     if err != nil {
         return err
     }
+    if reply.keepAlive {
+        return nil
+    }
     return errors.New(reply.Message)
 }
 
-func (self *ProxyServer) setDeadline(conn *net.TCPConn, s_id int) {
+func (self *ProxyServer) setDeadline(conn net.Conn, s_id int) {
     conn.SetDeadline(time.Now().Add(self.stratum[s_id].timeout))
 }
 
@@ -188,42 +301,3 @@ func (s *ProxyServer) removeSession(cs *Session) {
     defer stratum.sessionsMu.Unlock()
     delete(stratum.sessions, cs)
 }
-
-func (s *ProxyServer) broadcastNewJobs(s_id int) {
-    proxyConfig := s.config.Proxy
-    stratumConfig := proxyConfig.Stratum[s_id]
-    t := s.currentBlockTemplate()
-    if t == nil || len(t.Header) == 0 || s.isSick() {
-        return
-    }
-    stratum := s.stratum[s_id]
-    reply := []string{t.Header, t.Seed, stratum.diff}
-
-    stratum.sessionsMu.RLock()
-    defer stratum.sessionsMu.RUnlock()
-
-    count := len(stratum.sessions)
-    log.Printf("Broadcasting new job to %v miners on %s", count, stratumConfig.Name)
-    s.backend.WriteStratumState(proxyConfig.Name, stratumConfig.Name, stratumConfig.Listen, count, stratumConfig.Difficulty)
-    
-    start := time.Now()
-    bcast := make(chan int, 1024)
-    n := 0
-
-    for m, _ := range stratum.sessions {
-        n++
-        bcast <- n
-
-        go func(cs *Session) {
-            err := cs.pushNewJob(&reply)
-            <-bcast
-            if err != nil {
-                log.Printf("Job transmit error from %s to %v@%v: %v", stratumConfig.Name, cs.login, cs.ip, err)
-                s.removeSession(cs)
-            } else {
-                s.setDeadline(cs.conn, cs.s_id)
-            }
-        }(m)
-    }
-    log.Printf("Jobs broadcast on %s finished in %s", stratumConfig.Name, time.Since(start))
-}
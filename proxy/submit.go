@@ -0,0 +1,74 @@
+package proxy
+
+import (
+    "log"
+    "time"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/rpc"
+)
+
+type submitResult struct {
+    upstream    string
+    accepted    bool
+    err         error
+    elapsed     time.Duration
+}
+
+func (r *submitResult) log(height uint64) {
+    if r.err != nil {
+        log.Printf("Block %v submission to %s failed in %v: %v", height, r.upstream, r.elapsed, r.err)
+    } else if r.accepted {
+        log.Printf("Block %v accepted by %s in %v", height, r.upstream, r.elapsed)
+    } else {
+        log.Printf("Block %v rejected by %s in %v", height, r.upstream, r.elapsed)
+    }
+}
+
+// Submits block solution to all healthy upstreams at once and returns as soon as one accepts it.
+// Result is an error only if no upstream replied at all.
+func (s *ProxyServer) submitBlock(height uint64, params []string) (bool, error) {
+    upstreams := make([]*rpc.RPCClient, 0, len(s.upstreams))
+    for _, upstream := range s.upstreams {
+        if !upstream.Sick() {
+            upstreams = append(upstreams, upstream)
+        }
+    }
+    // Still worth a try if all upstreams are marked as sick
+    if len(upstreams) == 0 {
+        upstreams = append(upstreams, s.rpc())
+    }
+
+    results := make(chan *submitResult, len(upstreams))
+    for _, upstream := range upstreams {
+        go func(upstream *rpc.RPCClient) {
+            start := time.Now()
+            accepted, err := upstream.SubmitWork(params)
+            results <- &submitResult{upstream: upstream.Name, accepted: accepted, err: err, elapsed: time.Since(start)}
+        }(upstream)
+    }
+
+    var lastErr error
+    rejected := false
+    for i := range upstreams {
+        result := <-results
+        result.log(height)
+        if result.accepted {
+            // Log remaining replies, block is recorded only once
+            go func(n int) {
+                for j := 0; j < n; j++ {
+                    (<-results).log(height)
+                }
+            }(len(upstreams) - i - 1)
+            return true, nil
+        }
+        if result.err != nil {
+            lastErr = result.err
+        } else {
+            rejected = true
+        }
+    }
+    if rejected {
+        return false, nil
+    }
+    return false, lastErr
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "sync"
+    "time"
+)
+
+// Certificate files are checked for changes at most that often
+const tlsReloadInterval = 10 * time.Second
+
+var tlsVersions = map[string]uint16{
+    "1.0": tls.VersionTLS10,
+    "1.1": tls.VersionTLS11,
+    "1.2": tls.VersionTLS12,
+    "1.3": tls.VersionTLS13,
+}
+
+// Keeps certificate and client CA pool in memory and reloads them from disk
+// once files are modified, so renewed certificates are picked up without a restart.
+type tlsReloader struct {
+    sync.RWMutex
+    config       *StratumTLS
+    minVersion   uint16
+    cert         *tls.Certificate
+    clientCAs    *x509.CertPool
+    modTime      time.Time
+    checkedAt    time.Time
+}
+
+func newTLSConfig(cfg *StratumTLS) (*tls.Config, error) {
+    minVersion := uint16(tls.VersionTLS12)
+    if len(cfg.MinVersion) > 0 {
+        v, ok := tlsVersions[cfg.MinVersion]
+        if !ok {
+            return nil, fmt.Errorf("Unsupported TLS version %s", cfg.MinVersion)
+        }
+        minVersion = v
+    }
+    r := &tlsReloader{config: cfg, minVersion: minVersion}
+    err := r.load()
+    if err != nil {
+        return nil, err
+    }
+    return &tls.Config{GetConfigForClient: r.getConfigForClient}, nil
+}
+
+func (r *tlsReloader) lastModified() (time.Time, error) {
+    var modTime time.Time
+    for _, file := range []string{r.config.CertFile, r.config.KeyFile, r.config.ClientCA} {
+        if len(file) == 0 {
+            continue
+        }
+        info, err := os.Stat(file)
+        if err != nil {
+            return modTime, err
+        }
+        if info.ModTime().After(modTime) {
+            modTime = info.ModTime()
+        }
+    }
+    return modTime, nil
+}
+
+func (r *tlsReloader) load() error {
+    modTime, err := r.lastModified()
+    if err != nil {
+        return err
+    }
+    cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+    if err != nil {
+        return err
+    }
+    var clientCAs *x509.CertPool
+    if len(r.config.ClientCA) > 0 {
+        data, err := ioutil.ReadFile(r.config.ClientCA)
+        if err != nil {
+            return err
+        }
+        clientCAs = x509.NewCertPool()
+        if !clientCAs.AppendCertsFromPEM(data) {
+            return fmt.Errorf("No certificates found in %s", r.config.ClientCA)
+        }
+    }
+
+    r.Lock()
+    defer r.Unlock()
+    r.cert = &cert
+    r.clientCAs = clientCAs
+    r.modTime = modTime
+    r.checkedAt = time.Now()
+    return nil
+}
+
+func (r *tlsReloader) maybeReload() {
+    r.Lock()
+    if time.Since(r.checkedAt) < tlsReloadInterval {
+        r.Unlock()
+        return
+    }
+    r.checkedAt = time.Now()
+    loadedAt := r.modTime
+    r.Unlock()
+
+    modTime, err := r.lastModified()
+    if err != nil {
+        log.Printf("Failed to check TLS certificate %s: %v", r.config.CertFile, err)
+        return
+    }
+    if !modTime.After(loadedAt) {
+        return
+    }
+    // Keep serving previous certificate if new one is broken
+    err = r.load()
+    if err != nil {
+        log.Printf("Failed to reload TLS certificate %s: %v", r.config.CertFile, err)
+        return
+    }
+    log.Printf("Reloaded TLS certificate %s", r.config.CertFile)
+}
+
+func (r *tlsReloader) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+    r.maybeReload()
+
+    r.RLock()
+    defer r.RUnlock()
+    cfg := &tls.Config{
+        Certificates: []tls.Certificate{*r.cert},
+        MinVersion:   r.minVersion,
+    }
+    if r.clientCAs != nil {
+        cfg.ClientCAs = r.clientCAs
+        cfg.ClientAuth = tls.RequireAndVerifyClientCert
+    }
+    return cfg, nil
+}
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+    "fmt"
+    "log"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/rpc"
+)
+
+const (
+    UpstreamPriority = "priority"
+    UpstreamHeight = "height"
+    UpstreamLatency = "latency"
+    // Number of recent checks error rate is calculated over
+    upstreamErrorWindow = 20
+)
+
+// Result of recent checks of an upstream, used only by upstream checker
+type upstreamState struct {
+    alive       bool
+    height      uint64
+    peers       int
+    latency     time.Duration
+    history     []bool
+    failures    int
+}
+
+func (u *upstreamState) errorRate() float64 {
+    if len(u.history) == 0 {
+        return 0
+    }
+    return float64(u.failures) / float64(len(u.history)) * 100
+}
+
+func (u *upstreamState) record(ok bool) {
+    if len(u.history) == upstreamErrorWindow {
+        if !u.history[0] {
+            u.failures--
+        }
+        u.history = u.history[1:]
+    }
+    u.history = append(u.history, ok)
+    if !ok {
+        u.failures++
+    }
+}
+
+func probeUpstream(upstream *rpc.RPCClient, state *upstreamState) {
+    start := time.Now()
+    state.alive = upstream.Check()
+    state.latency = time.Since(start)
+    if state.alive {
+        height, err := upstream.GetHeight()
+        if err != nil {
+            state.alive = false
+        } else {
+            state.height = height
+        }
+    }
+    if state.alive {
+        peers, err := upstream.GetPeerCount()
+        if err != nil {
+            state.alive = false
+        } else {
+            state.peers = peers
+        }
+    }
+    state.record(state.alive)
+}
+
+// Returns empty string if upstream can be used or a reason why it can't
+func (s *ProxyServer) upstreamProblem(state *upstreamState, bestHeight uint64) string {
+    cfg := &s.config.UpstreamPolicy
+    if !state.alive {
+        return "not responding"
+    }
+    if state.height+cfg.MaxHeightLag < bestHeight {
+        return fmt.Sprintf("height %v behind %v", state.height, bestHeight)
+    }
+    if state.peers < cfg.MinPeers {
+        return fmt.Sprintf("%v peers", state.peers)
+    }
+    if cfg.MaxErrorRate > 0 && state.errorRate() > cfg.MaxErrorRate {
+        return fmt.Sprintf("%.0f%% errors", state.errorRate())
+    }
+    return ""
+}
+
+// Picks the best usable upstream according to strategy, -1 if there is none
+func (s *ProxyServer) bestUpstream(usable []bool) int {
+    best := -1
+    for i, state := range s.upstreamStates {
+        if !usable[i] {
+            continue
+        }
+        if best < 0 {
+            best = i
+            continue
+        }
+        switch s.config.UpstreamPolicy.Strategy {
+        case UpstreamHeight:
+            if state.height > s.upstreamStates[best].height {
+                best = i
+            }
+        case UpstreamLatency:
+            if state.latency < s.upstreamStates[best].latency {
+                best = i
+            }
+        }
+    }
+    return best
+}
+
+// Describes why candidate is better than current upstream, empty if it's not better enough
+func (s *ProxyServer) switchReason(current, candidate int) string {
+    cur := s.upstreamStates[current]
+    next := s.upstreamStates[candidate]
+    switch s.config.UpstreamPolicy.Strategy {
+    case UpstreamHeight:
+        if next.height > cur.height {
+            return fmt.Sprintf("height %v ahead of %v", next.height, cur.height)
+        }
+    case UpstreamLatency:
+        margin := 1 - s.config.UpstreamPolicy.LatencyMargin/100
+        if float64(next.latency) < float64(cur.latency)*margin {
+            return fmt.Sprintf("latency %v vs %v", next.latency, cur.latency)
+        }
+    default:
+        if candidate < current {
+            return "higher priority"
+        }
+    }
+    return ""
+}
+
+func (s *ProxyServer) checkUpstreams() {
+    var wg sync.WaitGroup
+    for i, upstream := range s.upstreams {
+        wg.Add(1)
+        go func(upstream *rpc.RPCClient, state *upstreamState) {
+            defer wg.Done()
+            probeUpstream(upstream, state)
+        }(upstream, s.upstreamStates[i])
+    }
+    wg.Wait()
+
+    bestHeight := uint64(0)
+    for _, state := range s.upstreamStates {
+        if state.alive && state.height > bestHeight {
+            bestHeight = state.height
+        }
+    }
+    usable := make([]bool, len(s.upstreams))
+    for i, state := range s.upstreamStates {
+        usable[i] = len(s.upstreamProblem(state, bestHeight)) == 0
+    }
+
+    current := int(atomic.LoadInt32(&s.upstream))
+    candidate := s.bestUpstream(usable)
+    if candidate < 0 {
+        // Nothing better than current one, keep it
+        s.pendingUpstream, s.pendingChecks = -1, 0
+        return
+    }
+    if candidate == current {
+        s.pendingUpstream, s.pendingChecks = -1, 0
+        return
+    }
+
+    var reason string
+    if problem := s.upstreamProblem(s.upstreamStates[current], bestHeight); len(problem) > 0 {
+        // Leave unusable upstream at once
+        reason = fmt.Sprintf("%v is %s", s.upstreams[current].Name, problem)
+    } else {
+        reason = s.switchReason(current, candidate)
+        if len(reason) == 0 {
+            s.pendingUpstream, s.pendingChecks = -1, 0
+            return
+        }
+        if s.pendingUpstream != candidate {
+            s.pendingUpstream, s.pendingChecks = candidate, 0
+        }
+        s.pendingChecks++
+        if s.pendingChecks < s.config.UpstreamPolicy.SwitchChecks {
+            return
+        }
+    }
+    s.pendingUpstream, s.pendingChecks = -1, 0
+    s.switchUpstream(candidate, reason)
+}
+
+func (s *ProxyServer) switchUpstream(i int, reason string) {
+    upstream := s.upstreams[i]
+    log.Printf("Switching to %v upstream: %s", upstream.Name, reason)
+    atomic.StoreInt32(&s.upstream, int32(i))
+
+    _, err := upstream.SetAddress(s.config.Proxy.Address)
+    if err != nil {
+        log.Printf("Failed to set mining address on %v upstream: %v", upstream.Name, err)
+    }
+    err = s.backend.WriteUpstreamState(s.config.Proxy.Name, upstream.Name, reason)
+    if err != nil {
+        log.Printf("Failed to write upstream state to backend: %v", err)
+    }
+}
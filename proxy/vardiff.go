@@ -0,0 +1,129 @@
+package proxy
+
+import (
+    "log"
+    "math"
+    "time"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/util"
+)
+
+type varDiff struct {
+    config          *VarDiff
+    targetTime      time.Duration
+    retargetTime    time.Duration
+}
+
+func newVarDiff(cfg *VarDiff) *varDiff {
+    if cfg.MinDiff <= 0 || cfg.MaxDiff < cfg.MinDiff {
+        log.Fatalf("Invalid vardiff bounds: minDiff %v, maxDiff %v", cfg.MinDiff, cfg.MaxDiff)
+    }
+    return &varDiff{
+        config:       cfg,
+        targetTime:   util.MustParseDuration(cfg.TargetTime),
+        retargetTime: util.MustParseDuration(cfg.RetargetTime),
+    }
+}
+
+func (v *varDiff) clamp(diff int64) int64 {
+    if diff < v.config.MinDiff {
+        return v.config.MinDiff
+    }
+    if diff > v.config.MaxDiff {
+        return v.config.MaxDiff
+    }
+    return diff
+}
+
+// Returns difficulty at which shares are submitted every targetTime on average,
+// the same one if average share time is within variance of targetTime.
+// No shares within elapsed time are treated as a single share, since difficulty is too high.
+func (v *varDiff) retarget(diff int64, elapsed time.Duration, shares int64) int64 {
+    if shares == 0 {
+        shares = 1
+    }
+    avg := elapsed / time.Duration(shares)
+    variance := float64(v.targetTime) * v.config.VariancePercent / 100
+    if math.Abs(float64(avg-v.targetTime)) <= variance {
+        return diff
+    }
+    return v.clamp(int64(float64(diff) * float64(v.targetTime) / float64(avg)))
+}
+
+func (cs *Session) setDifficulty(diff int64) {
+    cs.diffMu.Lock()
+    defer cs.diffMu.Unlock()
+    cs.diff = diff
+    cs.prevDiff = diff
+    cs.target = util.GetTargetHex(diff)
+    cs.lastRetarget = time.Now()
+}
+
+func (cs *Session) currentTarget() string {
+    cs.diffMu.RLock()
+    defer cs.diffMu.RUnlock()
+    return cs.target
+}
+
+func (cs *Session) currentDifficulty() int64 {
+    cs.diffMu.RLock()
+    defer cs.diffMu.RUnlock()
+    return cs.diff
+}
+
+// Returns difficulty a submitted share must be verified and credited with.
+// Right after retarget miner may still be working on a job with previous target,
+// so the lower of both is used for one share interval.
+func (s *ProxyServer) shareDifficulty(cs *Session) int64 {
+    cs.diffMu.RLock()
+    defer cs.diffMu.RUnlock()
+
+    v := s.stratum[cs.s_id].varDiff
+    if v != nil && cs.prevDiff < cs.diff && time.Since(cs.lastRetarget) < v.targetTime {
+        return cs.prevDiff
+    }
+    return cs.diff
+}
+
+// Retargets session difficulty so that miner submits a share every targetTime on average.
+// Returns true if difficulty has changed and a new job has to be pushed to the miner.
+func (s *ProxyServer) retargetSession(cs *Session, share bool) bool {
+    v := s.stratum[cs.s_id].varDiff
+    if v == nil {
+        return false
+    }
+    cs.diffMu.Lock()
+    defer cs.diffMu.Unlock()
+
+    if share {
+        cs.shares++
+    }
+    now := time.Now()
+    elapsed := now.Sub(cs.lastRetarget)
+    if elapsed < v.retargetTime {
+        return false
+    }
+
+    shares := cs.shares
+    cs.shares = 0
+    cs.lastRetarget = now
+
+    newDiff := v.retarget(cs.diff, elapsed, shares)
+    if newDiff == cs.diff {
+        return false
+    }
+    login, _, _ := cs.identity()
+    log.Printf("Retarget %v@%v from %v to %v, %v shares in %v", login, cs.ip, cs.diff, newDiff, shares, elapsed)
+    cs.prevDiff = cs.diff
+    cs.diff = newDiff
+    cs.target = util.GetTargetHex(newDiff)
+    return true
+}
+
+func (s *ProxyServer) initialDifficulty(s_id int) int64 {
+    diff := s.config.Proxy.Stratum[s_id].Difficulty
+    if v := s.stratum[s_id].varDiff; v != nil {
+        return v.clamp(diff)
+    }
+    return diff
+}
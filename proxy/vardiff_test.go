@@ -0,0 +1,57 @@
+package proxy
+
+import (
+    "testing"
+    "time"
+)
+
+func TestVarDiffRetarget(t *testing.T) {
+    v := &varDiff{
+        config:     &VarDiff{MinDiff: 1000, MaxDiff: 1000000, VariancePercent: 30},
+        targetTime: 10 * time.Second,
+    }
+    tests := []struct {
+        name      string
+        diff      int64
+        elapsed   time.Duration
+        shares    int64
+        expected  int64
+    }{
+        {"on target", 10000, 100 * time.Second, 10, 10000},
+        {"within variance above", 10000, 120 * time.Second, 10, 10000},
+        {"within variance below", 10000, 80 * time.Second, 10, 10000},
+        {"at variance bound", 10000, 130 * time.Second, 10, 10000},
+        {"too fast", 10000, 50 * time.Second, 10, 20000},
+        {"too slow", 10000, 200 * time.Second, 10, 5000},
+        {"no shares", 10000, 40 * time.Second, 0, 2500},
+        {"clamped to min", 2000, 100 * time.Second, 1, 1000},
+        {"clamped to max", 500000, 10 * time.Second, 10, 1000000},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got := v.retarget(tt.diff, tt.elapsed, tt.shares)
+            if got != tt.expected {
+                t.Errorf("retarget(%v, %v, %v) = %v, want %v", tt.diff, tt.elapsed, tt.shares, got, tt.expected)
+            }
+        })
+    }
+}
+
+func TestVarDiffClamp(t *testing.T) {
+    v := &varDiff{config: &VarDiff{MinDiff: 1000, MaxDiff: 5000}}
+    tests := []struct {
+        diff      int64
+        expected  int64
+    }{
+        {500, 1000},
+        {1000, 1000},
+        {3000, 3000},
+        {5000, 5000},
+        {9000, 5000},
+    }
+    for _, tt := range tests {
+        if got := v.clamp(tt.diff); got != tt.expected {
+            t.Errorf("clamp(%v) = %v, want %v", tt.diff, got, tt.expected)
+        }
+    }
+}
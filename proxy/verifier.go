@@ -0,0 +1,110 @@
+package proxy
+
+import (
+    "errors"
+    "log"
+    "math/big"
+    "runtime"
+    "sync/atomic"
+    "time"
+
+    "github.com/ethereum/go-ethereum/common"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/util"
+)
+
+const defaultVerifierQueueSize = 1024
+
+var errVerifierBusy = errors.New("Share verifier queue is full")
+
+type verifyResult struct {
+    valid       bool
+    block       bool
+    mixDigest   common.Hash
+}
+
+type verifyRequest struct {
+    share       Block
+    blockDiff   *big.Int
+    queuedAt    time.Time
+    reply       chan verifyResult
+}
+
+// Verifies shares on a fixed number of workers, so share floods can't take all CPUs
+type verifier struct {
+    // Accessed atomically, so keep them first in order to avoid alignment issue
+    verifyCount     int64
+    verifySum       int64
+
+    queue           chan *verifyRequest
+}
+
+func newVerifier(cfg *Verifier) *verifier {
+    workers := runtime.NumCPU()
+    if cfg.Workers > 0 {
+        workers = cfg.Workers
+    }
+    queueSize := defaultVerifierQueueSize
+    if cfg.QueueSize > 0 {
+        queueSize = cfg.QueueSize
+    }
+    v := &verifier{queue: make(chan *verifyRequest, queueSize)}
+    for i := 0; i < workers; i++ {
+        go v.worker()
+    }
+    log.Printf("Share verifier runs %v workers with queue of %v shares", workers, queueSize)
+    return v
+}
+
+func (v *verifier) worker() {
+    for req := range v.queue {
+        result := verifyShare(&req.share, req.blockDiff)
+        atomic.AddInt64(&v.verifyCount, 1)
+        atomic.AddInt64(&v.verifySum, int64(time.Since(req.queuedAt)))
+        req.reply <- result
+    }
+}
+
+// Returns whether share is valid, whether it's a block and its mix digest, fails at once if queue is full
+func (v *verifier) verify(share Block, blockDiff *big.Int) (verifyResult, error) {
+    req := &verifyRequest{share: share, blockDiff: blockDiff, queuedAt: time.Now(), reply: make(chan verifyResult, 1)}
+    select {
+    case v.queue <- req:
+    default:
+        return verifyResult{}, errVerifierBusy
+    }
+    return <-req.reply, nil
+}
+
+func (v *verifier) queueDepth() int {
+    return len(v.queue)
+}
+
+// Returns average time from queueing to verified result since previous call
+func (v *verifier) resetLatency() time.Duration {
+    count := atomic.SwapInt64(&v.verifyCount, 0)
+    sum := atomic.SwapInt64(&v.verifySum, 0)
+    if count == 0 {
+        return 0
+    }
+    return time.Duration(sum / count)
+}
+
+// Computes hash only once and checks it against both share and block targets.
+// Share without mix digest takes the computed one.
+func verifyShare(share *Block, blockDiff *big.Int) verifyResult {
+    if share.difficulty.Sign() <= 0 || blockDiff.Sign() <= 0 {
+        return verifyResult{}
+    }
+    mixDigest, result := hasher.Light.Compute(share.number, share.hashNoNonce, share.nonce)
+    if share.mixDigest != (common.Hash{}) && mixDigest != share.mixDigest {
+        return verifyResult{}
+    }
+    hash := result.Big()
+    shareTarget := new(big.Int).Div(util.Pow256, share.difficulty)
+    if hash.Cmp(shareTarget) > 0 {
+        return verifyResult{}
+    }
+    blockTarget := new(big.Int).Div(util.Pow256, blockDiff)
+    return verifyResult{valid: true, block: hash.Cmp(blockTarget) <= 0, mixDigest: mixDigest}
+}
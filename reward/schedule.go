@@ -0,0 +1,94 @@
+package reward
+
+import (
+    "errors"
+    "fmt"
+    "math"
+    "math/big"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/rpc"
+)
+
+const (
+    // 300000000 * 0.95^floor(height/500000)
+    SourceFormula = "formula"
+    SourceTable = "table"
+    // Whole coinbase value is the reward, transaction fees can't be told apart
+    SourceCoinbase = "coinbase"
+)
+
+// Block reward without transaction fees, shared by unlocker and PPS proxies
+type Schedule struct {
+    Source      string      `json:"source"`
+    Table       []Range     `json:"table"`
+}
+
+// Heights are inclusive, To of the last range must be 0 meaning no end
+type Range struct {
+    From        uint64      `json:"from"`
+    To          uint64      `json:"to"`
+    Reward      int64       `json:"reward"`
+}
+
+// Table must cover all heights starting from 0 without gaps or overlaps
+func (s *Schedule) Check() error {
+    switch s.Source {
+    case "", SourceFormula, SourceCoinbase:
+        return nil
+    case SourceTable:
+    default:
+        return fmt.Errorf("Unsupported reward schedule source %s", s.Source)
+    }
+    if len(s.Table) == 0 {
+        return errors.New("Reward schedule table is empty")
+    }
+    next := uint64(0)
+    for i, r := range s.Table {
+        if r.From != next {
+            return fmt.Errorf("Reward schedule range %v must start at height %v", i, next)
+        }
+        if r.Reward < 0 {
+            return fmt.Errorf("Reward schedule range %v has negative reward", i)
+        }
+        last := i == len(s.Table)-1
+        if last && r.To != 0 {
+            return errors.New("Reward schedule last range must be open with to = 0")
+        }
+        if !last {
+            if r.To < r.From {
+                return fmt.Errorf("Reward schedule range %v ends before it starts", i)
+            }
+            next = r.To + 1
+        }
+    }
+    return nil
+}
+
+// Returns false if reward is known only from coinbase of mined block
+func (s *Schedule) BlockReward(height uint64) (*big.Int, bool) {
+    switch s.Source {
+    case SourceCoinbase:
+        return nil, false
+    case SourceTable:
+        for _, r := range s.Table {
+            if height >= r.From && (r.To == 0 || height <= r.To) {
+                return big.NewInt(r.Reward), true
+            }
+        }
+        return new(big.Int), true
+    default:
+        return big.NewInt(int64(300000000 * math.Pow(0.95, math.Floor(float64(height*1.0)/500000)))), true
+    }
+}
+
+// Sum of coinbase outputs, that is block reward with transaction fees
+func CoinbaseValue(block *rpc.GetBlockReply) (*big.Int, error) {
+    if len(block.Transactions) == 0 || len(block.Transactions[0].Outputs) == 0 {
+        return nil, fmt.Errorf("Block %v has no coinbase outputs", block.Number)
+    }
+    value := new(big.Int)
+    for _, output := range block.Transactions[0].Outputs {
+        value.Add(value, big.NewInt(output.Value))
+    }
+    return value, nil
+}
@@ -0,0 +1,91 @@
+package reward
+
+import (
+    "testing"
+
+    "github.com/NotoriousPyro/open-metaverse-pool/rpc"
+)
+
+func TestScheduleCheck(t *testing.T) {
+    tests := []struct {
+        name      string
+        schedule  Schedule
+        err       bool
+    }{
+        {"default", Schedule{}, false},
+        {"formula", Schedule{Source: SourceFormula}, false},
+        {"coinbase", Schedule{Source: SourceCoinbase}, false},
+        {"unknown source", Schedule{Source: "halving"}, true},
+        {"empty table", Schedule{Source: SourceTable}, true},
+        {"single open range", Schedule{Source: SourceTable, Table: []Range{{0, 0, 100}}}, false},
+        {"ranges", Schedule{Source: SourceTable, Table: []Range{{0, 9, 100}, {10, 19, 50}, {20, 0, 25}}}, false},
+        {"not from zero", Schedule{Source: SourceTable, Table: []Range{{1, 0, 100}}}, true},
+        {"gap", Schedule{Source: SourceTable, Table: []Range{{0, 9, 100}, {11, 0, 50}}}, true},
+        {"overlap", Schedule{Source: SourceTable, Table: []Range{{0, 9, 100}, {9, 0, 50}}}, true},
+        {"ends before start", Schedule{Source: SourceTable, Table: []Range{{0, 9, 100}, {10, 5, 50}, {6, 0, 25}}}, true},
+        {"last range closed", Schedule{Source: SourceTable, Table: []Range{{0, 9, 100}, {10, 19, 50}}}, true},
+        {"negative reward", Schedule{Source: SourceTable, Table: []Range{{0, 0, -1}}}, true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            err := tt.schedule.Check()
+            if (err != nil) != tt.err {
+                t.Errorf("Check() error = %v, want error %v", err, tt.err)
+            }
+        })
+    }
+}
+
+func TestScheduleBlockReward(t *testing.T) {
+    table := Schedule{Source: SourceTable, Table: []Range{{0, 9, 100}, {10, 19, 50}, {20, 0, 25}}}
+    tests := []struct {
+        name      string
+        schedule  Schedule
+        height    uint64
+        reward    int64
+        ok        bool
+    }{
+        {"formula genesis", Schedule{}, 0, 300000000, true},
+        {"formula before first cut", Schedule{Source: SourceFormula}, 499999, 300000000, true},
+        {"formula first cut", Schedule{Source: SourceFormula}, 500000, 285000000, true},
+        {"formula second cut", Schedule{Source: SourceFormula}, 1000000, 270750000, true},
+        {"table first range", table, 0, 100, true},
+        {"table range end", table, 9, 100, true},
+        {"table range start", table, 10, 50, true},
+        {"table open range", table, 1000000, 25, true},
+        {"coinbase", Schedule{Source: SourceCoinbase}, 100, 0, false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            reward, ok := tt.schedule.BlockReward(tt.height)
+            if ok != tt.ok {
+                t.Fatalf("BlockReward(%v) ok = %v, want %v", tt.height, ok, tt.ok)
+            }
+            if ok && reward.Int64() != tt.reward {
+                t.Errorf("BlockReward(%v) = %v, want %v", tt.height, reward, tt.reward)
+            }
+        })
+    }
+}
+
+func TestCoinbaseValue(t *testing.T) {
+    block := &rpc.GetBlockReply{Transactions: []rpc.MVSTx{
+        {Outputs: []rpc.MVSTxOutput{{Value: 300000000}, {Value: 1500}}},
+        {Outputs: []rpc.MVSTxOutput{{Value: 7}}},
+    }}
+    value, err := CoinbaseValue(block)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if value.Int64() != 300001500 {
+        t.Errorf("CoinbaseValue() = %v, want 300001500", value)
+    }
+
+    if _, err := CoinbaseValue(&rpc.GetBlockReply{}); err == nil {
+        t.Error("CoinbaseValue() accepted block without transactions")
+    }
+    empty := &rpc.GetBlockReply{Transactions: []rpc.MVSTx{{}}}
+    if _, err := CoinbaseValue(empty); err == nil {
+        t.Error("CoinbaseValue() accepted coinbase without outputs")
+    }
+}
@@ -179,6 +179,22 @@ func (r *RPCClient) SendTransaction(from, to, value string) (string, error) {
     return reply.Hash, err
 }
 
+// Pays every receiver "address:value" in one transaction, change goes back to from address
+func (r *RPCClient) SendMore(from string, receivers []string) (string, error) {
+    params := []string{r.Account, r.Password}
+    for _, receiver := range receivers {
+        params = append(params, "--receivers", receiver)
+    }
+    params = append(params, "--mychange", from)
+    rpcResp, err := r.doPost(r.Url, "sendmore", params)
+    if err != nil {
+        return "", err
+    }
+    var reply MVSTx
+    err = json.Unmarshal(*rpcResp.Result, &reply)
+    return reply.Hash, err
+}
+
 func (r *RPCClient) GetTransaction(hash string) (*GetBlockReply, error) {
     rpcResp, err := r.doPost(r.Url, "gettx", []string{hash})
     if err != nil {
@@ -12,6 +12,20 @@ import (
     "github.com/NotoriousPyro/open-metaverse-pool/util"
 )
 
+// Payout schemes proxies and unlocker must agree on
+const (
+    SchemeProp = "prop"
+    SchemePPLNS = "pplns"
+    SchemePPS = "pps"
+)
+
+const (
+    // Share PoW marks are kept while shares for the height keep coming
+    powExpiration = 10 * time.Minute
+    // Retries of a batch whose reply was lost must come before its mark expires
+    shareBatchExpiration = time.Hour
+)
+
 type Config struct {
     Endpoint   string   `json:"endpoint"`
     Password   string   `json:"password"`
@@ -41,6 +55,8 @@ type BlockData struct {
     ImmatureReward string     `json:"-"`
     RewardString   string     `json:"reward"`
     RoundHeight    int64      `json:"-"`
+    Solo           bool       `json:"solo"`
+    Finder         string     `json:"finder,omitempty"`
     candidateKey   string
     immatureKey    string
 }
@@ -63,7 +79,11 @@ func (b *BlockData) RoundKey() string {
 }
 
 func (b *BlockData) key() string {
-    return join(b.UncleHeight, b.Orphan, b.Nonce, b.serializeHash(), b.Timestamp, b.Difficulty, b.TotalShares, b.Reward)
+    key := join(b.UncleHeight, b.Orphan, b.Nonce, b.serializeHash(), b.Timestamp, b.Difficulty, b.TotalShares, b.Reward)
+    if b.Solo {
+        return join(key, b.Finder)
+    }
+    return key
 }
 
 type Miner struct {
@@ -76,6 +96,21 @@ type Miner struct {
 type Worker struct {
     Miner
     TotalHR     int64   `json:"hr2"`
+    ReportedHR  int64   `json:"reportedHr"`
+    ClientId    string  `json:"clientId,omitempty"`
+}
+
+// Accepted share waiting to be written, timestamp is in milliseconds
+type Share struct {
+    Login       string
+    Id          string
+    Params      []string
+    Diff        int64
+    Height      uint64
+    Timestamp   int64
+    Solo        bool
+    // PPS value credited at once, 0 if share is paid when block is found
+    Reward      int64
 }
 
 func NewRedisClient(cfg *Config, prefix string) *RedisClient {
@@ -132,6 +167,20 @@ func (r *RedisClient) WriteStratumState(nodeId string, id string, listen string,
     return err
 }
 
+// Durations are stored in microseconds
+func (r *RedisClient) WriteBroadcastState(nodeId string, id string, elapsed, fanoutAvg, fanoutMax time.Duration) error {
+    tx := r.client.Multi()
+    defer tx.Close()
+
+    _, err := tx.Exec(func() error {
+        tx.HSet(r.formatKey("nodes", nodeId), join(id, "broadcastTime"), strconv.FormatInt(int64(elapsed/time.Microsecond), 10))
+        tx.HSet(r.formatKey("nodes", nodeId), join(id, "fanoutAvg"), strconv.FormatInt(int64(fanoutAvg/time.Microsecond), 10))
+        tx.HSet(r.formatKey("nodes", nodeId), join(id, "fanoutMax"), strconv.FormatInt(int64(fanoutMax/time.Microsecond), 10))
+        return nil
+    })
+    return err
+}
+
 func (r *RedisClient) GetStratumStates(nodeId string) ([]map[string]interface{}, error) {
     cmd := r.client.HGetAllMap(r.formatKey("nodes", nodeId))
     if cmd.Err() != nil {
@@ -157,7 +206,8 @@ func (r *RedisClient) GetStratumStates(nodeId string) ([]map[string]interface{},
     return v, nil
 }
 
-func (r *RedisClient) WriteNodeState(id string, height uint64, diff *big.Int) error {
+// Verification latency is stored in microseconds
+func (r *RedisClient) WriteNodeState(id string, height uint64, diff *big.Int, shareQueue, verifyQueue int, verifyLatency time.Duration) error {
     tx := r.client.Multi()
     defer tx.Close()
 
@@ -168,6 +218,25 @@ func (r *RedisClient) WriteNodeState(id string, height uint64, diff *big.Int) er
         tx.HSet(r.formatKey("nodes"), join(id, "height"), strconv.FormatUint(height, 10))
         tx.HSet(r.formatKey("nodes"), join(id, "difficulty"), diff.String())
         tx.HSet(r.formatKey("nodes"), join(id, "lastBeat"), strconv.FormatInt(now, 10))
+        tx.HSet(r.formatKey("nodes"), join(id, "shareQueue"), strconv.FormatInt(int64(shareQueue), 10))
+        tx.HSet(r.formatKey("nodes"), join(id, "verifyQueue"), strconv.FormatInt(int64(verifyQueue), 10))
+        tx.HSet(r.formatKey("nodes"), join(id, "verifyLatency"), strconv.FormatInt(int64(verifyLatency/time.Microsecond), 10))
+        return nil
+    })
+    return err
+}
+
+func (r *RedisClient) WriteUpstreamState(id string, upstream string, reason string) error {
+    tx := r.client.Multi()
+    defer tx.Close()
+
+    now := util.MakeTimestamp() / 1000
+
+    _, err := tx.Exec(func() error {
+        tx.HSet(r.formatKey("nodes"), join(id, "name"), id)
+        tx.HSet(r.formatKey("nodes"), join(id, "upstream"), upstream)
+        tx.HSet(r.formatKey("nodes"), join(id, "upstreamReason"), reason)
+        tx.HSet(r.formatKey("nodes"), join(id, "upstreamSwitchedAt"), strconv.FormatInt(now, 10))
         return nil
     })
     return err
@@ -205,31 +274,69 @@ func (r *RedisClient) checkPoWExist(height uint64, params []string) (bool, error
     return val == 0, err
 }
 
-func (r *RedisClient) WriteShare(login, id string, params []string, diff int64, height uint64, window time.Duration) (bool, error) {
-    exist, err := r.checkPoWExist(height, params)
+// Marks shares PoW as seen by batch in one round trip and returns which were seen by another batch,
+// possibly on another proxy. Checking the same batch again gives the same answer.
+func (r *RedisClient) CheckSharesExist(batchId string, shares []*Share) ([]bool, error) {
+    cmds, err := r.client.Pipelined(func(pipe *redis.Pipeline) error {
+        heights := make(map[uint64]bool)
+        for _, share := range shares {
+            powKey := r.formatKey("pow", share.Height)
+            member := strings.Join(share.Params, ":")
+            pipe.HSetNX(powKey, member, batchId)
+            pipe.HGet(powKey, member)
+            heights[share.Height] = true
+        }
+        for height := range heights {
+            pipe.Expire(r.formatKey("pow", height), powExpiration)
+        }
+        return nil
+    })
     if err != nil {
-        return false, err
+        return nil, err
     }
-    // Duplicate share, (nonce, powHash, mixDigest) pair exist
-    if exist {
-        return true, nil
+    exist := make([]bool, len(shares))
+    for i := range shares {
+        exist[i] = cmds[i*2+1].(*redis.StringCmd).Val() != batchId
+    }
+    return exist, nil
+}
+
+// Writes batch of shares in a single transaction which also marks batch as written,
+// so a batch retried after the reply was lost isn't written and credited twice
+func (r *RedisClient) WriteShares(batchId string, shares []*Share, window time.Duration, shareLog bool) error {
+    batchKey := r.formatKey("shares", "batches", batchId)
+    tx, err := r.client.Watch(batchKey)
+    if err != nil {
+        return err
     }
-    tx := r.client.Multi()
     defer tx.Close()
 
-    ms := util.MakeTimestamp()
-    ts := ms / 1000
+    written, err := tx.Exists(batchKey).Result()
+    if err != nil || written {
+        return err
+    }
 
     _, err = tx.Exec(func() error {
-        r.writeShare(tx, ms, ts, login, id, diff, window)
-        tx.HIncrBy(r.formatKey("stats"), "roundShares", diff)
+        for _, share := range shares {
+            r.writeShare(tx, share.Timestamp, share.Timestamp/1000, share.Login, share.Id, share.Diff, window, share.Solo)
+            if !share.Solo {
+                tx.HIncrBy(r.formatKey("stats"), "roundShares", share.Diff)
+                if shareLog {
+                    r.writeShareLog(tx, share.Timestamp, share.Login, share.Diff, share.Params[0])
+                }
+            }
+            if share.Reward > 0 {
+                r.writePPSCredit(tx, share.Login, share.Reward)
+            }
+        }
+        tx.Set(batchKey, len(shares), shareBatchExpiration)
         return nil
     })
-    return false, err
+    return err
 }
 
-func (r *RedisClient) WriteBlock(login, id string, params []string, diff, roundDiff int64, height uint64, window time.Duration) (bool, error) {
-    exist, err := r.checkPoWExist(height, params)
+func (r *RedisClient) WriteBlock(share *Share, roundDiff int64, window time.Duration, shareLog bool) (bool, error) {
+    exist, err := r.checkPoWExist(share.Height, share.Params)
     if err != nil {
         return false, err
     }
@@ -237,20 +344,32 @@ func (r *RedisClient) WriteBlock(login, id string, params []string, diff, roundD
     if exist {
         return true, nil
     }
+    if share.Solo {
+        return false, r.writeSoloBlock(share, roundDiff, window)
+    }
     tx := r.client.Multi()
     defer tx.Close()
 
-    ms := util.MakeTimestamp()
+    ms := share.Timestamp
     ts := ms / 1000
+    login, nonce := share.Login, share.Params[0]
 
     cmds, err := tx.Exec(func() error {
-        r.writeShare(tx, ms, ts, login, id, diff, window)
+        r.writeShare(tx, ms, ts, login, share.Id, share.Diff, window, false)
         tx.HSet(r.formatKey("stats"), "lastBlockFound", strconv.FormatInt(ts, 10))
         tx.HDel(r.formatKey("stats"), "roundShares")
         tx.ZIncrBy(r.formatKey("finders"), 1, login)
         tx.HIncrBy(r.formatKey("miners", login), "blocksFound", 1)
-        tx.Rename(r.formatKey("shares", "roundCurrent"), r.formatRound(int64(height), params[0]))
-        tx.HGetAllMap(r.formatRound(int64(height), params[0]))
+        tx.Rename(r.formatKey("shares", "roundCurrent"), r.formatRound(int64(share.Height), nonce))
+        tx.HGetAllMap(r.formatRound(int64(share.Height), nonce))
+        if shareLog {
+            r.writeShareLog(tx, ms, login, share.Diff, nonce)
+            // Block position in share log is kept until block is matured or orphaned
+            tx.HSet(r.formatKey("shares", "logBlocks"), nonce, join(ms, roundDiff))
+        }
+        if share.Reward > 0 {
+            r.writePPSCredit(tx, login, share.Reward)
+        }
         return nil
     })
     if err != nil {
@@ -262,21 +381,105 @@ func (r *RedisClient) WriteBlock(login, id string, params []string, diff, roundD
             n, _ := strconv.ParseInt(v, 10, 64)
             totalShares += n
         }
-        hashHex := strings.Join(params, ":")
+        hashHex := strings.Join(share.Params, ":")
         s := join(hashHex, ts, roundDiff, totalShares)
-        cmd := r.client.ZAdd(r.formatKey("blocks", "candidates"), redis.Z{Score: float64(height), Member: s})
+        cmd := r.client.ZAdd(r.formatKey("blocks", "candidates"), redis.Z{Score: float64(share.Height), Member: s})
         return false, cmd.Err()
     }
 }
 
-func (r *RedisClient) writeShare(tx *redis.Multi, ms, ts int64, login, id string, diff int64, expire time.Duration) {
-    tx.HIncrBy(r.formatKey("shares", "roundCurrent"), login, diff)
-    tx.ZAdd(r.formatKey("hashrate"), redis.Z{Score: float64(ts), Member: join(diff, login, id, ms)})
+// Solo block write is retried that many times while other solo shares keep coming
+const soloBlockAttempts = 10
+
+// Solo round consists of finder's own shares only, other solo miners keep their progress.
+// Transaction fails if any solo share is written meanwhile, it's retried then.
+func (r *RedisClient) writeSoloBlock(share *Share, roundDiff int64, window time.Duration) error {
+    var err error
+    for i := 0; i < soloBlockAttempts; i++ {
+        err = r.writeSoloBlockTx(share, roundDiff, window)
+        if err != redis.TxFailedErr {
+            return err
+        }
+    }
+    return err
+}
+
+// Finder's shares are read under WATCH, then reset together with writing round and candidate
+func (r *RedisClient) writeSoloBlockTx(share *Share, roundDiff int64, window time.Duration) error {
+    soloKey := r.formatKey("shares", "soloCurrent")
+    login := share.Login
+    tx, err := r.client.Watch(soloKey)
+    if err != nil {
+        return err
+    }
+    defer tx.Close()
+
+    soloShares, err := tx.HGet(soloKey, login).Int64()
+    if err != nil && err != redis.Nil {
+        return err
+    }
+    totalShares := soloShares + share.Diff
+
+    ms := share.Timestamp
+    ts := ms / 1000
+    hashHex := strings.Join(share.Params, ":")
+    s := join(hashHex, ts, roundDiff, totalShares, login)
+
+    _, err = tx.Exec(func() error {
+        r.writeShare(tx, ms, ts, login, share.Id, share.Diff, window, true)
+        tx.HSet(r.formatKey("stats"), "lastSoloBlockFound", strconv.FormatInt(ts, 10))
+        tx.ZIncrBy(r.formatKey("finders"), 1, login)
+        tx.HIncrBy(r.formatKey("miners", login), "blocksFound", 1)
+        tx.HDel(soloKey, login)
+        tx.HSet(r.formatRound(int64(share.Height), share.Params[0]), login, strconv.FormatInt(totalShares, 10))
+        tx.ZAdd(r.formatKey("blocks", "candidates"), redis.Z{Score: float64(share.Height), Member: s})
+        return nil
+    })
+    return err
+}
+
+// Solo shares are kept apart from pooled round and pool hashrate
+func (r *RedisClient) writeShare(tx *redis.Multi, ms, ts int64, login, id string, diff int64, expire time.Duration, solo bool) {
+    if solo {
+        tx.HIncrBy(r.formatKey("shares", "soloCurrent"), login, diff)
+        tx.ZAdd(r.formatKey("solo", "hashrate"), redis.Z{Score: float64(ts), Member: join(diff, login, id, ms)})
+    } else {
+        tx.HIncrBy(r.formatKey("shares", "roundCurrent"), login, diff)
+        tx.ZAdd(r.formatKey("hashrate"), redis.Z{Score: float64(ts), Member: join(diff, login, id, ms)})
+    }
     tx.ZAdd(r.formatKey("hashrate", login), redis.Z{Score: float64(ts), Member: join(diff, id, ms)})
     tx.Expire(r.formatKey("hashrate", login), expire) // Will delete hashrates for miners that gone
     tx.HSet(r.formatKey("miners", login), "lastShare", strconv.FormatInt(ts, 10))
 }
 
+// Pooled shares ordered by time for PPLNS, "login:diff:nonce"
+func (r *RedisClient) writeShareLog(tx *redis.Multi, ms int64, login string, diff int64, nonce string) {
+    tx.ZAdd(r.formatKey("shares", "log"), redis.Z{Score: float64(ms), Member: join(login, diff, nonce)})
+}
+
+// PPS shares are paid from pool reserve, which is refilled by found blocks
+func (r *RedisClient) writePPSCredit(tx *redis.Multi, login string, amount int64) {
+    tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
+    tx.HIncrBy(r.formatKey("finances"), "balance", amount)
+    tx.HIncrBy(r.formatKey("finances"), "reserve", -amount)
+    tx.HIncrBy(r.formatKey("finances"), "ppsPaid", amount)
+}
+
+// Hashrate reported by mining software, worker => "hashrate:clientId:timestamp"
+func (r *RedisClient) WriteReportedHashrate(login, id string, hashrate int64, clientId string, expire time.Duration) error {
+    tx := r.client.Multi()
+    defer tx.Close()
+
+    ts := util.MakeTimestamp() / 1000
+
+    _, err := tx.Exec(func() error {
+        tx.HSet(r.formatKey("reported", login), id, join(hashrate, clientId, ts))
+        tx.Expire(r.formatKey("reported", login), expire)
+        return nil
+    })
+    return err
+}
+
 func (r *RedisClient) formatKey(args ...interface{}) string {
     return join(r.prefix, join(args...))
 }
@@ -335,6 +538,14 @@ func (r *RedisClient) GetImmatureBlocks(maxHeight int64) ([]*BlockData, error) {
     return convertBlockResults(cmd), nil
 }
 
+func (r *RedisClient) GetMaturedBlocks(count int64) ([]*BlockData, error) {
+    cmd := r.client.ZRevRangeWithScores(r.formatKey("blocks", "matured"), 0, count-1)
+    if cmd.Err() != nil {
+        return nil, cmd.Err()
+    }
+    return convertBlockResults(cmd), nil
+}
+
 func (r *RedisClient) GetRoundShares(height int64, nonce string) (map[string]int64, error) {
     result := make(map[string]int64)
     cmd := r.client.HGetAllMap(r.formatRound(height, nonce))
@@ -349,6 +560,117 @@ func (r *RedisClient) GetRoundShares(height int64, nonce string) (map[string]int
     return result, nil
 }
 
+// Position of pooled block in share log, timestamp is in milliseconds
+type ShareLogBlock struct {
+    Timestamp   int64
+    Difficulty  int64
+}
+
+const shareLogPageSize = 10000
+
+// Pooled shares paid for block by PPLNS, false if block isn't in share log
+func (r *RedisClient) GetPPLNSShares(nonce string, window int64) (map[string]int64, int64, bool, error) {
+    value, err := r.client.HGet(r.formatKey("shares", "logBlocks"), nonce).Result()
+    if err == redis.Nil {
+        return nil, 0, false, nil
+    } else if err != nil {
+        return nil, 0, false, err
+    }
+    ms, _ := strconv.ParseInt(strings.Split(value, ":")[0], 10, 64)
+
+    result := make(map[string]int64)
+    _, total, err := r.scanShareLog(ms, window, func(login string, diff int64) {
+        result[login] += diff
+    })
+    if err != nil {
+        return nil, 0, false, err
+    }
+    return result, total, true, nil
+}
+
+// Blocks which are still not matured or orphaned, so their shares must be kept
+func (r *RedisClient) GetShareLogBlocks() (map[string]*ShareLogBlock, error) {
+    cmd := r.client.HGetAllMap(r.formatKey("shares", "logBlocks"))
+    if cmd.Err() != nil {
+        return nil, cmd.Err()
+    }
+    result := make(map[string]*ShareLogBlock)
+    for nonce, v := range cmd.Val() {
+        // "timestamp:diff"
+        fields := strings.Split(v, ":")
+        block := &ShareLogBlock{}
+        block.Timestamp, _ = strconv.ParseInt(fields[0], 10, 64)
+        if len(fields) > 1 {
+            block.Difficulty, _ = strconv.ParseInt(fields[1], 10, 64)
+        }
+        result[nonce] = block
+    }
+    return result, nil
+}
+
+// Removes shares older than window of share difficulty ending at until, returns number of removed shares
+func (r *RedisClient) TrimShareLog(until, window int64) (int64, error) {
+    oldest, total, err := r.scanShareLog(until, window, nil)
+    if err != nil {
+        return 0, err
+    }
+    // Log is shorter than window, everything is still needed
+    if total < window {
+        return 0, nil
+    }
+    return r.client.ZRemRangeByScore(r.formatKey("shares", "log"), "-inf", fmt.Sprint("(", oldest)).Result()
+}
+
+// Share difficulty counted from the newest share back, till window is filled.
+// The oldest share is counted only partially if it doesn't fit window.
+type shareLogWindow struct {
+    window    int64
+    total     int64
+    // Timestamp of the oldest counted share
+    oldest    int64
+    fn        func(login string, diff int64)
+}
+
+// Counts "login:diff:nonce" share log entry, returns false once window is filled
+func (w *shareLogWindow) add(member string, ms int64) bool {
+    fields := strings.Split(member, ":")
+    diff, _ := strconv.ParseInt(fields[1], 10, 64)
+    if w.total+diff > w.window {
+        diff = w.window - w.total
+    }
+    if w.fn != nil {
+        w.fn(fields[0], diff)
+    }
+    w.total += diff
+    w.oldest = ms
+    return w.total < w.window
+}
+
+// Walks share log from newest share at or before until, till window of share difficulty is filled.
+// Returns timestamp of the oldest visited share and total difficulty visited.
+func (r *RedisClient) scanShareLog(until, window int64, fn func(login string, diff int64)) (int64, int64, error) {
+    w := &shareLogWindow{window: window, fn: fn}
+    max := strconv.FormatInt(until, 10)
+
+    for offset := int64(0); w.total < window; offset += shareLogPageSize {
+        option := redis.ZRangeByScore{Min: "-inf", Max: max, Offset: offset, Count: shareLogPageSize}
+        cmd := r.client.ZRevRangeByScoreWithScores(r.formatKey("shares", "log"), option)
+        if cmd.Err() != nil {
+            return 0, 0, cmd.Err()
+        }
+        page := cmd.Val()
+        for _, v := range page {
+            if !w.add(v.Member.(string), int64(v.Score)) {
+                break
+            }
+        }
+        if len(page) < shareLogPageSize {
+            break
+        }
+    }
+    return w.oldest, w.total, nil
+}
+
 func (r *RedisClient) GetPayees() ([]string, error) {
     payees := make(map[string]struct{})
     var result []string
@@ -385,9 +707,9 @@ func (r *RedisClient) GetBalance(login string) (int64, error) {
     return cmd.Int64()
 }
 
-func (r *RedisClient) LockPayouts(login string, amount int64) error {
+func (r *RedisClient) LockPayouts(payments []*PendingPayment) error {
     key := r.formatKey("payments", "lock")
-    result := r.client.SetNX(key, join(login, amount), 0).Val()
+    result := r.client.SetNX(key, formatPendingBatch(payments), 0).Val()
     if !result {
         return fmt.Errorf("Unable to acquire lock '%s'", key)
     }
@@ -400,6 +722,27 @@ func (r *RedisClient) UnlockPayouts() error {
     return err
 }
 
+// Sets payout scheme if it's not set yet, "scheme:timestamp".
+// Returns scheme in effect and unix time it's in effect since.
+func (r *RedisClient) ClaimPayoutScheme(scheme string) (string, int64, error) {
+    key := r.formatKey("scheme")
+    ts := util.MakeTimestamp() / 1000
+    err := r.client.SetNX(key, join(scheme, ts), 0).Err()
+    if err != nil {
+        return "", 0, err
+    }
+    value, err := r.client.Get(key).Result()
+    if err != nil {
+        return "", 0, err
+    }
+    fields := strings.SplitN(value, ":", 2)
+    if len(fields) < 2 {
+        return "", 0, fmt.Errorf("Malformed payout scheme '%s'", value)
+    }
+    since, _ := strconv.ParseInt(fields[1], 10, 64)
+    return fields[0], since, nil
+}
+
 func (r *RedisClient) IsPayoutsLocked() (bool, error) {
     _, err := r.client.Get(r.formatKey("payments", "lock")).Result()
     if err == redis.Nil {
@@ -415,70 +758,95 @@ type PendingPayment struct {
     Timestamp int64  `json:"timestamp"`
     Amount    int64  `json:"amount"`
     Address   string `json:"login"`
+    // Pending record of batch payment belongs to
+    batch     string
+}
+
+// Payments sent in one transaction share one pending record "address:amount,address:amount,..."
+func formatPendingBatch(payments []*PendingPayment) string {
+    entries := make([]string, len(payments))
+    for i, payment := range payments {
+        entries[i] = join(payment.Address, payment.Amount)
+    }
+    return strings.Join(entries, ",")
 }
 
 func (r *RedisClient) GetPendingPayments() []*PendingPayment {
     raw := r.client.ZRevRangeWithScores(r.formatKey("payments", "pending"), 0, -1)
     var result []*PendingPayment
     for _, v := range raw.Val() {
-        // timestamp -> "address:amount"
-        payment := PendingPayment{}
-        payment.Timestamp = int64(v.Score)
-        fields := strings.Split(v.Member.(string), ":")
-        payment.Address = fields[0]
-        payment.Amount, _ = strconv.ParseInt(fields[1], 10, 64)
-        result = append(result, &payment)
+        // timestamp -> "address:amount,address:amount,..."
+        batch := v.Member.(string)
+        for _, entry := range strings.Split(batch, ",") {
+            payment := PendingPayment{batch: batch}
+            payment.Timestamp = int64(v.Score)
+            fields := strings.Split(entry, ":")
+            payment.Address = fields[0]
+            payment.Amount, _ = strconv.ParseInt(fields[1], 10, 64)
+            result = append(result, &payment)
+        }
     }
     return result
 }
 
-// Deduct miner's balance for payment
-func (r *RedisClient) UpdateBalance(login string, amount int64) error {
+// Deduct balances of miners paid in one transaction and log it as one pending record
+func (r *RedisClient) UpdateBalance(payments []*PendingPayment) error {
     tx := r.client.Multi()
     defer tx.Close()
 
     ts := util.MakeTimestamp() / 1000
 
     _, err := tx.Exec(func() error {
-        tx.HIncrBy(r.formatKey("miners", login), "balance", (amount * -1))
-        tx.HIncrBy(r.formatKey("miners", login), "pending", amount)
-        tx.HIncrBy(r.formatKey("finances"), "balance", (amount * -1))
-        tx.HIncrBy(r.formatKey("finances"), "pending", amount)
-        tx.ZAdd(r.formatKey("payments", "pending"), redis.Z{Score: float64(ts), Member: join(login, amount)})
+        for _, payment := range payments {
+            login, amount := payment.Address, payment.Amount
+            tx.HIncrBy(r.formatKey("miners", login), "balance", (amount * -1))
+            tx.HIncrBy(r.formatKey("miners", login), "pending", amount)
+            tx.HIncrBy(r.formatKey("finances"), "balance", (amount * -1))
+            tx.HIncrBy(r.formatKey("finances"), "pending", amount)
+        }
+        tx.ZAdd(r.formatKey("payments", "pending"), redis.Z{Score: float64(ts), Member: formatPendingBatch(payments)})
         return nil
     })
     return err
 }
 
-func (r *RedisClient) RollbackBalance(login string, amount int64) error {
+// Credits back given pending payments and removes their pending records
+func (r *RedisClient) RollbackBalance(payments []*PendingPayment) error {
     tx := r.client.Multi()
     defer tx.Close()
 
     _, err := tx.Exec(func() error {
-        tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
-        tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
-        tx.HIncrBy(r.formatKey("finances"), "balance", amount)
-        tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
-        tx.ZRem(r.formatKey("payments", "pending"), join(login, amount))
+        for _, payment := range payments {
+            login, amount := payment.Address, payment.Amount
+            tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
+            tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
+            tx.HIncrBy(r.formatKey("finances"), "balance", amount)
+            tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
+            tx.ZRem(r.formatKey("payments", "pending"), payment.batch)
+        }
         return nil
     })
     return err
 }
 
-func (r *RedisClient) WritePayment(login, txHash string, amount int64) error {
+// Logs payment for every recipient of transaction, removes its pending record and unlocks payouts
+func (r *RedisClient) WritePayment(txHash string, payments []*PendingPayment) error {
     tx := r.client.Multi()
     defer tx.Close()
 
     ts := util.MakeTimestamp() / 1000
 
     _, err := tx.Exec(func() error {
-        tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
-        tx.HIncrBy(r.formatKey("miners", login), "paid", amount)
-        tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
-        tx.HIncrBy(r.formatKey("finances"), "paid", amount)
-        tx.ZAdd(r.formatKey("payments", "all"), redis.Z{Score: float64(ts), Member: join(txHash, login, amount)})
-        tx.ZAdd(r.formatKey("payments", login), redis.Z{Score: float64(ts), Member: join(txHash, amount)})
-        tx.ZRem(r.formatKey("payments", "pending"), join(login, amount))
+        for _, payment := range payments {
+            login, amount := payment.Address, payment.Amount
+            tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
+            tx.HIncrBy(r.formatKey("miners", login), "paid", amount)
+            tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
+            tx.HIncrBy(r.formatKey("finances"), "paid", amount)
+            tx.ZAdd(r.formatKey("payments", "all"), redis.Z{Score: float64(ts), Member: join(txHash, login, amount)})
+            tx.ZAdd(r.formatKey("payments", login), redis.Z{Score: float64(ts), Member: join(txHash, amount)})
+        }
+        tx.ZRem(r.formatKey("payments", "pending"), formatPendingBatch(payments))
         tx.Del(r.formatKey("payments", "lock"))
         return nil
     })
@@ -503,7 +871,7 @@ func (r *RedisClient) WriteImmatureBlock(block *BlockData, roundRewards map[stri
     return err
 }
 
-func (r *RedisClient) WriteMaturedBlock(block *BlockData, roundRewards map[string]int64) error {
+func (r *RedisClient) WriteMaturedBlock(block *BlockData, roundRewards map[string]int64, reserve int64) error {
     creditKey := r.formatKey("credits", "immature", block.RoundHeight, block.Hash)
     tx, err := r.client.Watch(creditKey)
     // Must decrement immatures using existing log entry
@@ -537,6 +905,12 @@ func (r *RedisClient) WriteMaturedBlock(block *BlockData, roundRewards map[strin
             tx.HSetNX(r.formatKey("credits", block.Height, block.Hash), login, strconv.FormatInt(amount, 10))
         }
         tx.Del(creditKey)
+        if reserve > 0 {
+            tx.HIncrBy(r.formatKey("finances"), "reserve", reserve)
+            tx.HIncrBy(r.formatKey("finances"), "ppsMined", reserve)
+            // Kept for reversal report of reorged block
+            tx.HSetNX(r.formatKey("credits", "reserve"), join(block.Height, block.Hash), strconv.FormatInt(reserve, 10))
+        }
         tx.HIncrBy(r.formatKey("finances"), "balance", total)
         tx.HIncrBy(r.formatKey("finances"), "immature", (totalImmature * -1))
         tx.HSet(r.formatKey("finances"), "lastCreditHeight", strconv.FormatInt(block.Height, 10))
@@ -574,6 +948,93 @@ func (r *RedisClient) WriteOrphan(block *BlockData) error {
     return err
 }
 
+// Flags credited block which is no longer in chain, copies its credits into reversal report and halts given module.
+// Returns miner credits and PPS reserve to be reversed, false if block was flagged before, so resumed module isn't halted again.
+func (r *RedisClient) WriteReorg(block *BlockData, newHash, haltModule string) (map[string]int64, int64, bool, error) {
+    member := join(block.Height, block.Hash)
+    flagged, err := r.client.SIsMember(r.formatKey("reorgs", "flagged"), member).Result()
+    if err != nil {
+        return nil, 0, false, err
+    }
+    if flagged {
+        return nil, 0, false, nil
+    }
+    cmd := r.client.HGetAllMap(r.formatKey("credits", block.Height, block.Hash))
+    if cmd.Err() != nil {
+        return nil, 0, false, cmd.Err()
+    }
+    credits := make(map[string]int64)
+    total := int64(0)
+    for login, v := range cmd.Val() {
+        amount, _ := strconv.ParseInt(v, 10, 64)
+        credits[login] = amount
+        total += amount
+    }
+    reserve, err := r.client.HGet(r.formatKey("credits", "reserve"), member).Int64()
+    if err != nil && err != redis.Nil {
+        return nil, 0, false, err
+    }
+    total += reserve
+
+    tx := r.client.Multi()
+    defer tx.Close()
+
+    ts := util.MakeTimestamp() / 1000
+    _, err = tx.Exec(func() error {
+        tx.SAdd(r.formatKey("reorgs", "flagged"), member)
+        tx.ZAdd(r.formatKey("reorgs"), redis.Z{Score: float64(block.Height), Member: join(block.Hash, newHash, ts, total)})
+        for login, amount := range credits {
+            tx.HSet(r.formatKey("reorgs", block.Height, block.Hash), login, strconv.FormatInt(amount, 10))
+        }
+        if reserve > 0 {
+            tx.HSet(r.formatKey("reorgs", block.Height, block.Hash), "reserve", strconv.FormatInt(reserve, 10))
+        }
+        tx.HSet(r.formatKey("halts"), haltModule, join(ts, fmt.Sprintf("Reorg of credited block %v:%v", block.Height, block.Hash)))
+        return nil
+    })
+    if err != nil {
+        return nil, 0, false, err
+    }
+    return credits, reserve, true, nil
+}
+
+// Halted module stays suspended until halt is removed, "timestamp:reason"
+func (r *RedisClient) WriteHalt(module, reason string) error {
+    ts := util.MakeTimestamp() / 1000
+    return r.client.HSet(r.formatKey("halts"), module, join(ts, reason)).Err()
+}
+
+// Returns reason module is halted for, empty if it's not halted
+func (r *RedisClient) GetHalt(module string) (string, error) {
+    value, err := r.client.HGet(r.formatKey("halts"), module).Result()
+    if err == redis.Nil {
+        return "", nil
+    } else if err != nil {
+        return "", err
+    }
+    return strings.SplitN(value, ":", 2)[1], nil
+}
+
+func (r *RedisClient) GetHalts() (map[string]interface{}, error) {
+    cmd := r.client.HGetAllMap(r.formatKey("halts"))
+    if cmd.Err() != nil {
+        return nil, cmd.Err()
+    }
+    result := make(map[string]interface{})
+    for module, v := range cmd.Val() {
+        fields := strings.SplitN(v, ":", 2)
+        ts, _ := strconv.ParseInt(fields[0], 10, 64)
+        result[module] = map[string]interface{}{"timestamp": ts, "reason": fields[1]}
+    }
+    return result, nil
+}
+
+// Returns false if module wasn't halted
+func (r *RedisClient) ResumeHalt(module string) (bool, error) {
+    n, err := r.client.HDel(r.formatKey("halts"), module).Result()
+    return n > 0, err
+}
+
 func (r *RedisClient) WritePendingOrphans(blocks []*BlockData) error {
     tx := r.client.Multi()
     defer tx.Close()
@@ -598,6 +1059,7 @@ func (r *RedisClient) writeImmatureBlock(tx *redis.Multi, block *BlockData) {
 
 func (r *RedisClient) writeMaturedBlock(tx *redis.Multi, block *BlockData) {
     tx.Del(r.formatRound(block.RoundHeight, block.Nonce))
+    tx.HDel(r.formatKey("shares", "logBlocks"), block.Nonce)
     tx.ZRem(r.formatKey("blocks", "immature"), block.immatureKey)
     tx.ZAdd(r.formatKey("blocks", "matured"), redis.Z{Score: float64(block.Height), Member: block.key()})
 }
@@ -617,6 +1079,7 @@ func (r *RedisClient) GetMinerStats(login string, maxPayments int64) (map[string
         tx.ZRevRangeWithScores(r.formatKey("payments", login), 0, maxPayments-1)
         tx.ZCard(r.formatKey("payments", login))
         tx.HGet(r.formatKey("shares", "roundCurrent"), login)
+        tx.HGet(r.formatKey("shares", "soloCurrent"), login)
         return nil
     })
 
@@ -630,6 +1093,8 @@ func (r *RedisClient) GetMinerStats(login string, maxPayments int64) (map[string
         stats["paymentsTotal"] = cmds[2].(*redis.IntCmd).Val()
         roundShares, _ := cmds[3].(*redis.StringCmd).Int64()
         stats["roundShares"] = roundShares
+        soloShares, _ := cmds[4].(*redis.StringCmd).Int64()
+        stats["soloShares"] = soloShares
     }
 
     return stats, nil
@@ -707,6 +1172,9 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPaym
         tx.ZCard(r.formatKey("blocks", "matured"))
         tx.ZCard(r.formatKey("payments", "all"))
         tx.ZRevRangeWithScores(r.formatKey("payments", "all"), 0, maxPayments-1)
+        tx.ZRemRangeByScore(r.formatKey("solo", "hashrate"), "-inf", fmt.Sprint("(", now-window))
+        tx.ZRangeWithScores(r.formatKey("solo", "hashrate"), 0, -1)
+        tx.HGetAllMap(r.formatKey("finances"))
         return nil
     })
 
@@ -736,6 +1204,14 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPaym
     stats["miners"] = miners
     stats["minersTotal"] = len(miners)
     stats["hashrate"] = totalHashrate
+
+    soloHashrate, soloMiners := convertMinersStats(window, cmds[12].(*redis.ZSliceCmd))
+    stats["soloMiners"] = soloMiners
+    stats["soloMinersTotal"] = len(soloMiners)
+    stats["soloHashrate"] = soloHashrate
+
+    finances, _ := cmds[13].(*redis.StringStringMapCmd).Result()
+    stats["pps"] = convertPPSStats(finances)
     return stats, nil
 }
 
@@ -752,6 +1228,7 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
     cmds, err := tx.Exec(func() error {
         tx.ZRemRangeByScore(r.formatKey("hashrate", login), "-inf", fmt.Sprint("(", now-largeWindow))
         tx.ZRangeWithScores(r.formatKey("hashrate", login), 0, -1)
+        tx.HGetAllMap(r.formatKey("reported", login))
         return nil
     })
 
@@ -761,10 +1238,33 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 
     totalHashrate := int64(0)
     currentHashrate := int64(0)
+    reportedHashrate := int64(0)
     online := int64(0)
     offline := int64(0)
     workers := convertWorkersStats(smallWindow, cmds[1].(*redis.ZSliceCmd))
 
+    reported, _ := cmds[2].(*redis.StringStringMapCmd).Result()
+    for id, value := range reported {
+        // "hashrate:clientId:timestamp"
+        fields := strings.Split(value, ":")
+        if len(fields) < 3 {
+            continue
+        }
+        ts, _ := strconv.ParseInt(fields[2], 10, 64)
+        if ts < now-smallWindow {
+            continue
+        }
+        worker, ok := workers[id]
+        if !ok {
+            // Mining software is alive, but no shares were accepted
+            worker.startedAt = ts
+            worker.LastBeat = ts
+        }
+        worker.ReportedHR, _ = strconv.ParseInt(fields[0], 10, 64)
+        worker.ClientId = fields[1]
+        workers[id] = worker
+    }
+
     for id, worker := range workers {
         timeOnline := now - worker.startedAt
         if timeOnline < 600 {
@@ -792,6 +1292,7 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 
         currentHashrate += worker.HR
         totalHashrate += worker.TotalHR
+        reportedHashrate += worker.ReportedHR
         workers[id] = worker
     }
     stats["workers"] = workers
@@ -800,6 +1301,7 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
     stats["workersOffline"] = offline
     stats["hashrate"] = totalHashrate
     stats["currentHashrate"] = currentHashrate
+    stats["reportedHashrate"] = reportedHashrate
     return stats, nil
 }
 
@@ -860,7 +1362,7 @@ func (r *RedisClient) CollectLuckStats(windows []int) (map[string]interface{}, e
 func convertCandidateResults(raw *redis.ZSliceCmd) []*BlockData {
     var result []*BlockData
     for _, v := range raw.Val() {
-        // "nonce:powHash:mixDigest:timestamp:diff:totalShares"
+        // "nonce:powHash:mixDigest:timestamp:diff:totalShares[:finder]"
         block := BlockData{}
         block.Height = int64(v.Score)
         block.RoundHeight = block.Height
@@ -871,6 +1373,11 @@ func convertCandidateResults(raw *redis.ZSliceCmd) []*BlockData {
         block.Timestamp, _ = strconv.ParseInt(fields[3], 10, 64)
         block.Difficulty, _ = strconv.ParseInt(fields[4], 10, 64)
         block.TotalShares, _ = strconv.ParseInt(fields[5], 10, 64)
+        // Only solo blocks carry finder
+        if len(fields) > 6 {
+            block.Solo = true
+            block.Finder = fields[6]
+        }
         block.candidateKey = v.Member.(string)
         result = append(result, &block)
     }
@@ -881,7 +1388,7 @@ func convertBlockResults(rows ...*redis.ZSliceCmd) []*BlockData {
     var result []*BlockData
     for _, row := range rows {
         for _, v := range row.Val() {
-            // "uncleHeight:orphan:nonce:blockHash:timestamp:diff:totalShares:rewardInWei"
+            // "uncleHeight:orphan:nonce:blockHash:timestamp:diff:totalShares:rewardInWei[:finder]"
             block := BlockData{}
             block.Height = int64(v.Score)
             block.RoundHeight = block.Height
@@ -896,6 +1403,10 @@ func convertBlockResults(rows ...*redis.ZSliceCmd) []*BlockData {
             block.TotalShares, _ = strconv.ParseInt(fields[6], 10, 64)
             block.RewardString = fields[7]
             block.ImmatureReward = fields[7]
+            if len(fields) > 8 {
+                block.Solo = true
+                block.Finder = fields[8]
+            }
             block.immatureKey = v.Member.(string)
             result = append(result, &block)
         }
@@ -903,6 +1414,23 @@ func convertBlockResults(rows ...*redis.ZSliceCmd) []*BlockData {
     return result
 }
 
+// Reserve balance and how much found blocks differ from PPS payouts, in percent
+func convertPPSStats(finances map[string]string) map[string]interface{} {
+    reserve, _ := strconv.ParseInt(finances["reserve"], 10, 64)
+    paid, _ := strconv.ParseInt(finances["ppsPaid"], 10, 64)
+    mined, _ := strconv.ParseInt(finances["ppsMined"], 10, 64)
+    variance := float64(0)
+    if paid > 0 {
+        variance = float64(mined-paid) / float64(paid) * 100
+    }
+    return map[string]interface{}{
+        "reserve":  reserve,
+        "paid":     paid,
+        "mined":    mined,
+        "variance": variance,
+    }
+}
+
 // Build per login workers's total shares map {'rig-1': 12345, 'rig-2': 6789, ...}
 // TS => diff, id, ms
 func convertWorkersStats(window int64, raw *redis.ZSliceCmd) map[string]Worker {
@@ -0,0 +1,63 @@
+package storage
+
+import (
+    "reflect"
+    "testing"
+)
+
+type logEntry struct {
+    member    string
+    ms        int64
+}
+
+func TestShareLogWindow(t *testing.T) {
+    // Newest first, as share log is scanned
+    log := []logEntry{
+        {"alice:100:0x5", 5000},
+        {"bob:300:0x4", 4000},
+        {"alice:200:0x3", 3000},
+        {"carol:400:0x2", 2000},
+        {"bob:500:0x1", 1000},
+    }
+    tests := []struct {
+        name      string
+        window    int64
+        shares    map[string]int64
+        total     int64
+        oldest    int64
+        visited   int
+    }{
+        {"newest share only", 100, map[string]int64{"alice": 100}, 100, 5000, 1},
+        {"exact fit", 600, map[string]int64{"alice": 300, "bob": 300}, 600, 3000, 3},
+        {"partial oldest share", 700, map[string]int64{"alice": 300, "bob": 300, "carol": 100}, 700, 2000, 4},
+        {"partial first share", 50, map[string]int64{"alice": 50}, 50, 5000, 1},
+        {"log shorter than window", 5000, map[string]int64{"alice": 300, "bob": 800, "carol": 400}, 1500, 1000, 5},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            shares := make(map[string]int64)
+            w := &shareLogWindow{window: tt.window, fn: func(login string, diff int64) {
+                shares[login] += diff
+            }}
+            visited := 0
+            for _, entry := range log {
+                visited++
+                if !w.add(entry.member, entry.ms) {
+                    break
+                }
+            }
+            if !reflect.DeepEqual(shares, tt.shares) {
+                t.Errorf("shares = %v, want %v", shares, tt.shares)
+            }
+            if w.total != tt.total {
+                t.Errorf("total = %v, want %v", w.total, tt.total)
+            }
+            if w.oldest != tt.oldest {
+                t.Errorf("oldest = %v, want %v", w.oldest, tt.oldest)
+            }
+            if visited != tt.visited {
+                t.Errorf("visited %v shares, want %v", visited, tt.visited)
+            }
+        })
+    }
+}
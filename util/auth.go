@@ -0,0 +1,21 @@
+package util
+
+import (
+    "crypto/subtle"
+    "log"
+    "net/http"
+)
+
+// Token must be passed as "Authorization: Bearer <token>"
+func BearerAuth(token string, next http.HandlerFunc) http.HandlerFunc {
+    expected := []byte("Bearer " + token)
+    return func(w http.ResponseWriter, r *http.Request) {
+        auth := []byte(r.Header.Get("Authorization"))
+        if subtle.ConstantTimeCompare(auth, expected) != 1 {
+            log.Printf("Unauthorized admin API request from %s", r.RemoteAddr)
+            w.WriteHeader(http.StatusUnauthorized)
+            return
+        }
+        next(w, r)
+    }
+}